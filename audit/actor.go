@@ -0,0 +1,138 @@
+package audit
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ActorSource is one entry of actor_sources: a session setting, such as
+// audit_star.changed_by, application_name or request.jwt.claims, and for
+// settings holding JSON the dot separated path of the actor within it, such
+// as sub or app_metadata.user_id
+type ActorSource struct {
+	Setting string `yaml:"setting"`
+	Path    string `yaml:"path"`
+}
+
+// creates the functions the audit functions resolve the actor of a change
+// with. settings which are missing or empty resolve to NULL, as do those not
+// holding a JSON object or array where a path is given. they run for every
+// audited row, so values are told apart by their first character rather
+// than by catching a failed cast, which would start a subtransaction each
+// time; a value which starts like JSON but is not fails the change
+func createActorFunctions(db *session, c *Config) error {
+	if c.JSONType != "jsonb" {
+		if len(c.ActorSources) > 0 {
+			return errors.New("actor_sources requires a database which supports jsonb")
+		}
+		return nil
+	}
+
+	query := `CREATE OR REPLACE FUNCTION audit.actor_value(setting TEXT, path TEXT[])
+		RETURNS TEXT AS
+		$$
+			SELECT CASE
+				WHEN path IS NULL THEN v.value
+				WHEN v.value ~ '^\s*[{[]' THEN NULLIF(v.value::JSONB #>> path, '')
+			END
+			FROM (SELECT NULLIF(current_setting(setting, true), '') AS value) v;
+		$$
+		LANGUAGE sql
+		STABLE;
+
+		CREATE OR REPLACE FUNCTION audit.actor_context(settings TEXT[])
+		RETURNS JSONB AS
+		$$
+			SELECT NULLIF(COALESCE(jsonb_object_agg(s.setting, CASE
+				WHEN s.value ~ '^\s*[{[]' THEN s.value::JSONB
+				ELSE to_jsonb(s.value)
+			END), '{}'), '{}')
+			FROM (
+				SELECT setting, NULLIF(current_setting(setting, true), '') AS value
+				FROM unnest(settings) setting
+			) s
+			WHERE s.value IS NOT NULL;
+		$$
+		LANGUAGE sql
+		STABLE;`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	db.log.Info("actor functions created", Fields{"step": "audit_schema"})
+	return nil
+}
+
+// returns the expression the audit functions record as changed_by: the
+// first of the actor sources which is set, or audit_star.changed_by when
+// none are configured
+func changedByExpression(c *Config) string {
+	if len(c.ActorSources) == 0 {
+		return "current_setting('audit_star.changed_by')"
+	}
+
+	values := make([]string, len(c.ActorSources))
+	for i, source := range c.ActorSources {
+		path := "NULL"
+		if source.Path != "" {
+			path = sqlTextArray(strings.Split(source.Path, "."))
+		}
+		values[i] = "audit.actor_value(" + pq.QuoteLiteral(source.Setting) + ", " + path + ")"
+	}
+
+	return "COALESCE(" + strings.Join(values, ", ") + ")"
+}
+
+// returns the expression the audit functions record as actor_context: the
+// raw value of every setting of the actor sources
+func actorContextExpression(c *Config) string {
+	var settings []string
+	for _, source := range c.ActorSources {
+		if !contains(settings, source.Setting) {
+			settings = append(settings, source.Setting)
+		}
+	}
+
+	return "audit.actor_context(" + sqlTextArray(settings) + ")"
+}
+
+// widens the changed_by column of audit tables provisioned when it was a
+// VARCHAR(50). the views read it, so they are dropped to be created again
+// by the rest of the run
+func widenChangedBy(schema, table string, db *session) error {
+	var dataType string
+	err := db.QueryRow(`SELECT data_type FROM information_schema.columns
+		WHERE table_schema = $1 AND table_name = $2 AND column_name = 'changed_by'`, schema+"_audit_raw", table+"_audit").Scan(&dataType)
+	if err != nil || dataType == "text" {
+		return err
+	}
+
+	data := map[string]interface{}{
+		"schema": schema,
+		"table":  table,
+	}
+
+	query, err := parseQuery(`DROP VIEW IF EXISTS "{{.schema}}_audit"."{{.table}}_audit";
+		DROP VIEW IF EXISTS "{{.schema}}_audit"."{{.table}}_audit_delta";
+		DROP VIEW IF EXISTS "{{.schema}}_audit"."{{.table}}_audit_snapshot";
+		DROP VIEW IF EXISTS "{{.schema}}_audit"."{{.table}}_audit_compare";
+		ALTER TABLE "{{.schema}}_audit_raw"."{{.table}}_audit" ALTER COLUMN changed_by TYPE TEXT;`, data)
+	if err != nil {
+		return err
+	}
+
+	err = db.inTx(func(tx *session) error {
+		_, err := tx.Exec(query)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	db.log.Info("widened changed_by", Fields{"schema": schema, "table": table, "step": "add_column"})
+	return nil
+}
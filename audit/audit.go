@@ -4,99 +4,282 @@ import (
 
 	// postgres driver
 	"bytes"
+	"context"
 	"database/sql"
-	"flag"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
-	yaml "gopkg.in/yaml.v2"
+	"github.com/lib/pq"
+	yaml "gopkg.in/yaml.v3"
 )
 
 // Config ...
 type Config struct {
-	CfgPath         string
-	Host            string   `yaml:"host"`
-	Port            string   `yaml:"port"`
-	DBName          string   `yaml:"db_name"`
-	DBUser          string   `yaml:"username"`
-	DBPassword      string   `yaml:"password"`
-	SSLMode         string   `yaml:"ssl_mode"`
-	ExcludedTables  []string `yaml:"excluded_tables"`
-	ExcludedSchemas []string `yaml:"excluded_schemas"`
-	IncludedTables  []string `yaml:"included_tables"`
+	CfgPath             string                 `yaml:"-"`
+	Host                string                 `yaml:"host"`
+	Port                string                 `yaml:"port"`
+	DBName              string                 `yaml:"db_name"`
+	DBUser              string                 `yaml:"username"`
+	DBPassword          string                 `yaml:"password"`
+	SSLMode             string                 `yaml:"ssl_mode"`
+	SSLRootCert         string                 `yaml:"ssl_root_cert"`
+	SSLCert             string                 `yaml:"ssl_cert"`
+	SSLKey              string                 `yaml:"ssl_key"`
+	DSN                 string                 `yaml:"dsn"`
+	ExcludedTables      []string               `yaml:"excluded_tables"`
+	ExcludedSchemas     []string               `yaml:"excluded_schemas"`
+	IncludedTables      []string               `yaml:"included_tables"`
+	Security            string                 `yaml:"security"`
+	LogClientQuery      bool                   `yaml:"log_client_query"`
+	Owner               string                 `yaml:"owner"`
+	ViewsOnly           bool                   `yaml:"views_only"`
+	Grantee             string                 `yaml:"grantee"`
+	OwnerRole           string                 `yaml:"set_role"`
+	LockTimeout         string                 `yaml:"lock_timeout"`
+	PayloadEngine       string                 `yaml:"payload_engine"`
+	SkipNoopUpdates     bool                   `yaml:"skip_noop_updates"`
+	ValueMaxLength      int                    `yaml:"value_max_length"`
+	QueryMaxLength      int                    `yaml:"query_max_length"`
+	Retention           string                 `yaml:"retention"`
+	JSONType            string                 `yaml:"-"`
+	Tables              map[string]TableConfig `yaml:"tables"`
+	Databases           []DatabaseConfig       `yaml:"databases"`
+	Parallelism         int                    `yaml:"parallelism"`
+	LogFormat           string                 `yaml:"log_format"`
+	LogLevel            string                 `yaml:"log_level"`
+	Report              string                 `yaml:"report"`
+	ContinueOnError     bool                   `yaml:"continue_on_error"`
+	HashChain           bool                   `yaml:"hash_chain"`
+	CheckpointKey       string                 `yaml:"checkpoint_key"`
+	CheckpointPublicKey string                 `yaml:"checkpoint_public_key"`
+	CheckpointFile      string                 `yaml:"checkpoint_file"`
+	MaintenanceRole     string                 `yaml:"maintenance_role"`
+	RowSecurity         bool                   `yaml:"row_security"`
+	TenantColumn        string                 `yaml:"tenant_column"`
+	TenantSetting       string                 `yaml:"tenant_setting"`
+	Grants              []GrantConfig          `yaml:"grants"`
+	ActorSources        []ActorSource          `yaml:"actor_sources"`
+	UpdatedBy           UpdatedByConfig        `yaml:"updated_by"`
+
+	// the line of each setting in the config file, used to report problems
+	lines map[string]int
+}
+
+// TableConfig holds the settings which only apply to some tables, keyed by
+// a fully-qualified name or table pattern in the tables section of the
+// config. Unset fields fall back to the global settings.
+type TableConfig struct {
 	Security        string   `yaml:"security"`
-	LogClientQuery  bool     `yaml:"log_client_query"`
-	Owner           string   `yaml:"owner"`
-	ViewsOnly       bool     `yaml:"views_only"`
+	LogClientQuery  *bool    `yaml:"log_client_query"`
+	ValueMaxLength  int      `yaml:"value_max_length"`
+	QueryMaxLength  int      `yaml:"query_max_length"`
+	ExcludedColumns []string `yaml:"excluded_columns"`
 	Grantee         string   `yaml:"grantee"`
-	OwnerRole       string   `yaml:"set_role"`
-	LockTimeout     string   `yaml:"lock_timeout"`
-	JSONType        string
+	Retention       string   `yaml:"retention"`
+	Trigger         string   `yaml:"trigger"`
+	StoreFullRow    *bool    `yaml:"store_full_row"`
+	SkipNoopUpdates *bool    `yaml:"skip_noop_updates"`
+	IgnoredColumns  []string `yaml:"ignored_columns"`
+	HashChain       *bool    `yaml:"hash_chain"`
+	PersonalColumns []string `yaml:"personal_columns"`
+	RowSecurity     *bool    `yaml:"row_security"`
+	TenantColumn    string   `yaml:"tenant_column"`
+}
+
+// the settings a table is provisioned with once its entries in the tables
+// section have been merged over the global settings
+type tableOptions struct {
+	security        string
+	logClientQuery  bool
+	valueMaxLength  int
+	queryMaxLength  int
+	excludedColumns []string
+	grantee         string
+	retention       string
+	enableTrigger   bool
+	storeFullRow    bool
+	skipNoopUpdates bool
+	ignoredColumns  []string
+	hashChain       bool
+	personalColumns []string
+	rowSecurity     bool
+	tenantColumn    string
+	tenantSetting   string
 }
 
 type tableSettings struct {
 	enableTable   bool
 	enableTrigger bool
+	rule          string
 }
 
-var cfgPath = flag.String("cfg", "audit.yml", "Path to config file used by audit_star.")
-var selectedTable = flag.String("table", "", "A single fully-qualified table name to be provisioned for auditing.")
-
-var errorCounter int
-
-// ParseFlags parses command line flags for configration from command line input
-func ParseFlags(c *Config) error {
-	flag.Parse()
-	c.CfgPath = *cfgPath
-
-	return nil
+// TableSelection describes whether a table is audited and which rule of the
+// config decided it
+type TableSelection struct {
+	Schema   string `json:"schema"`
+	Table    string `json:"table"`
+	Selected bool   `json:"selected"`
+	Rule     string `json:"rule"`
 }
 
+// DefaultConfigPath is the config file read when no other is given
+const DefaultConfigPath = "audit.yml"
+
+// ParseTableName splits a fully-qualified table name into its schema and
+// table
 func ParseTableName(tableName string) ([]string, error) {
 	tableParts := strings.Split(tableName, ".")
-	if len(tableParts) > 1 {
+	if len(tableParts) > 1 && tableParts[0] != "" && tableParts[len(tableParts)-1] != "" {
 		return tableParts, nil
 	}
 
 	return nil, fmt.Errorf("table should be specified in the following format: schemaname.tablename")
 }
 
-// GetConfig pulls config info from audit.yml and command line input
+// GetConfig pulls config info from audit.yml and command line input. Nothing
+// is read when no config file is set. Unknown or duplicate keys are returned
+// as ConfigErrors, the values themselves are checked by Validate.
 func GetConfig(c *Config) error {
+	if c.CfgPath == "" {
+		return nil
+	}
+
 	file, err := ioutil.ReadFile(c.CfgPath)
 	if err != nil {
 		return err
 	}
 
-	err = yaml.Unmarshal(file, &c)
+	// unknown and duplicate keys are errors rather than silently ignored
+	decoder := yaml.NewDecoder(bytes.NewReader(file))
+	decoder.KnownFields(true)
+	decodeErr := decoder.Decode(&expandedConfig{c})
+	if decodeErr == io.EOF {
+		decodeErr = nil
+	}
+
+	var node yaml.Node
+	err = yaml.Unmarshal(file, &node)
 	if err != nil {
+		return decodeErrors(err)
+	}
+	c.lines = map[string]int{}
+	recordLines(&node, "", c.lines)
+
+	// the settings which could be decoded are kept, so Validate can still
+	// report the problems of the rest of the config
+	if decodeErr != nil {
+		return decodeErrors(decodeErr)
+	}
+
+	return nil
+}
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandedConfig decodes a config file with every ${NAME} in its values
+// replaced by the value of the environment variable NAME, or with nothing
+// when it is not set. Values are replaced once parsed, so whatever they hold
+// is taken as is rather than as YAML.
+type expandedConfig struct {
+	c *Config
+}
+
+// UnmarshalYAML expands the parsed document before decoding it, with the same
+// decoder so unknown keys are still reported
+func (e *expandedConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&envExpander{}); err != nil {
 		return err
 	}
+	return unmarshal(e.c)
+}
+
+type envExpander struct{}
 
+func (*envExpander) UnmarshalYAML(node *yaml.Node) error {
+	expandEnv(node)
 	return nil
 }
 
-// ParseCLI Overrides parses CLI override flags
-func ParseCLIOverrides(c *Config) error {
-	// CLI overrides
-	if *selectedTable == "" {
+// replaces every ${NAME} in the scalar values below node, leaving mapping
+// keys as they are. plain values are resolved again, so ${PORT} may still
+// set a number
+func expandEnv(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			expandEnv(node.Content[i])
+		}
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			expandEnv(child)
+		}
+	case yaml.ScalarNode:
+		if !envReference.MatchString(node.Value) {
+			return
+		}
+		node.Value = envReference.ReplaceAllStringFunc(node.Value, func(reference string) string {
+			return os.Getenv(envReference.FindStringSubmatch(reference)[1])
+		})
+		if node.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+			node.Tag = ""
+		}
+	}
+}
+
+// Set changes the setting with the given key, as named in the config file,
+// to a value given as text such as a command line flag. Problems with the
+// setting are then reported without a line in the file.
+func (c *Config) Set(key, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0] != key || key == "-" {
+			continue
+		}
+
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a boolean", key, value)
+			}
+			field.SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a number", key, value)
+			}
+			field.SetInt(int64(n))
+		default:
+			return fmt.Errorf("%s cannot be set from a single value", key)
+		}
+
+		delete(c.lines, key)
 		return nil
 	}
 
-	c.IncludedTables = []string{*selectedTable}
-	return nil
+	return fmt.Errorf("unknown setting %s", key)
 }
 
 // DBOpen opens the db connection
 func DBOpen(c *Config) (*sql.DB, error) {
-	dbInfo := fmt.Sprintf("host=%s port=%s user=%s dbname=%s sslmode=%s",
-		c.Host, c.Port, c.DBUser, c.DBName, c.SSLMode)
-	if c.DBPassword != "" {
-		dbInfo += fmt.Sprintf(" password=%s", c.DBPassword)
+	dbInfo, err := connString(c)
+	if err != nil {
+		return nil, err
 	}
 
 	db, err := sql.Open("postgres", dbInfo)
@@ -106,44 +289,121 @@ func DBOpen(c *Config) (*sql.DB, error) {
 	if err = db.Ping(); err != nil {
 		return nil, err
 	}
-	log.Println("successfully connected to", c.DBName)
 
-	err = setOwnerRole(db, c)
-	if err != nil {
-		return nil, err
+	return db, nil
+}
+
+// builds the connection string from the dsn setting, or DATABASE_URL when it
+// is empty, with the individual connection settings appended so they take
+// precedence. anything left unset falls back to the PG* environment
+// variables, and a missing password to ~/.pgpass, as handled by lib/pq.
+// set_role and lock_timeout are passed as options, so every connection of
+// the pool starts with them rather than only the first one
+func connString(c *Config) (string, error) {
+	dsn := c.DSN
+	if dsn == "" {
+		dsn = os.Getenv("DATABASE_URL")
+	}
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		dsn, err = pq.ParseURL(dsn)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	settings := []struct {
+		key   string
+		value string
+	}{
+		{"host", c.Host},
+		{"port", c.Port},
+		{"user", c.DBUser},
+		{"dbname", c.DBName},
+		{"sslmode", c.SSLMode},
+		{"sslrootcert", c.SSLRootCert},
+		{"sslcert", c.SSLCert},
+		{"sslkey", c.SSLKey},
+		{"password", c.DBPassword},
+	}
+
+	parts := []string{}
+	if dsn != "" {
+		parts = append(parts, dsn)
+	}
+	for _, setting := range settings {
+		if setting.value != "" {
+			parts = append(parts, setting.key+"="+quoteConnValue(setting.value))
+		}
+	}
+
+	var options []string
+	if c.OwnerRole != "" {
+		options = append(options, "-c role="+escapeOption(c.OwnerRole))
+	}
+	if c.LockTimeout != "" {
+		options = append(options, "-c lock_timeout="+escapeOption(c.LockTimeout))
+	}
+	if len(options) > 0 {
+		parts = append(parts, "options="+quoteConnValue(strings.Join(options, " ")))
 	}
 
-	setLockTimeout(db, c)
+	return strings.Join(parts, " "), nil
+}
+
+// escapes the spaces of a value in the options the server starts a session
+// with, which are otherwise taken as separators
+func escapeOption(value string) string {
+	return strings.NewReplacer(`\`, `\\`, " ", `\ `).Replace(value)
+}
+
+// quotes a value for a key=value connection string
+func quoteConnValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
+
+// Apply makes a list of all of the db's tables, marks which tables to exclude
+// based on the config, then loops over all the tables and sets up auditting
+// for each table. The returned report lists the outcome of every table, up to
+// the one which failed when an error is returned.
+func (p *Provisioner) Apply(ctx context.Context, q Querier) (*RunReport, error) {
+	db, config, err := p.session(ctx, q)
 	if err != nil {
 		return nil, err
 	}
+	report := &RunReport{Database: config.DBName, StartedAt: time.Now()}
+	err = runAll(db, config, report)
+	report.FinishedAt = time.Now()
+	report.sort()
 
-	return db, nil
+	if err == nil && p.table != "" && !report.has(p.table) {
+		err = fmt.Errorf("table %s does not exist", p.table)
+	}
+
+	return report, err
 }
 
-// RunAll makes a list of all of the db's tables, marks which tables to exclude
-// based on the config, then loops over all the tables and sets up auditting
-// for each table
-func RunAll(db *sql.DB, config *Config) error {
+func runAll(db *session, config *Config, report *RunReport) error {
 	// query the db for a list of all of its schemas
 	allSchemas, err := getAllSchemas(db, config)
 	if err != nil {
 		return err
 	}
 
-	filteredScehmas := filterSchemas(allSchemas, config)
-
 	// use the results from above to get a list of all of the tables in the db
 	allTables, err := getAllTables(db, config, allSchemas)
 	if err != nil {
 		return err
 	}
 
-	// exclude tables from audit based on ExcludedSchemas in config
-	filteredTables := filterTableSchemas(allTables, config)
+	// exclude tables from audit based on ExcludedTables, ExcludedSchemas and
+	// IncludedTables in config
+	filteredTables := filterTables(allTables, config)
 
-	// exclude tables from audit based on ExcludedTables in config
-	filteredTables = filterTables(filteredTables, config)
+	filteredScehmas := filterSchemas(allSchemas, filteredTables, config)
 
 	// having this set in the db is a pre-condition of running audit_star
 	err = ensureSettingExists("audit_star.changed_by", db)
@@ -161,7 +421,42 @@ func RunAll(db *sql.DB, config *Config) error {
 		return err
 	}
 
-	err = createNoDMLAuditFunction(db)
+	err = createGrantsTable(db)
+	if err != nil {
+		return err
+	}
+
+	err = createTenantMembersTable(db)
+	if err != nil {
+		return err
+	}
+
+	err = createNoDMLAuditFunction(db, config)
+	if err != nil {
+		return err
+	}
+
+	err = createMaintenanceLogTable(db, config)
+	if err != nil {
+		return err
+	}
+
+	err = createHashChainFunctions(db)
+	if err != nil {
+		return err
+	}
+
+	err = createStaleViewsTable(db)
+	if err != nil {
+		return err
+	}
+
+	err = createDDLHistoryTable(db)
+	if err != nil {
+		return err
+	}
+
+	err = createEventTriggers(db)
 	if err != nil {
 		return err
 	}
@@ -171,51 +466,242 @@ func RunAll(db *sql.DB, config *Config) error {
 		return err
 	}
 
-	err = createRawAuditSchemas(db, config, filteredScehmas)
+	err = checkPayloadEngine(config)
+	if err != nil {
+		return err
+	}
+	db.log.Info("using payload engine", Fields{"payload_engine": config.PayloadEngine})
+
+	err = createJSONArrayTextFunction(db, config)
+	if err != nil {
+		return err
+	}
+
+	err = createActorFunctions(db, config)
 	if err != nil {
 		return err
 	}
 
-	err = grantUsageOnSchemas(db, config, filteredScehmas)
+	err = createRawAuditSchemas(db, config, filteredScehmas)
 	if err != nil {
 		return err
 	}
 
-	log.Println("finished granting usage on schemas")
+	err = grantFunctions(config, db)
+	if err != nil {
+		return err
+	}
 
 	// calls all of the code which sets up all of the auditing dbs and triggers
-	err = setAuditing(filteredTables, config, db)
+	err = setAuditing(filteredTables, config, db, report)
+
+	fields := Fields{
+		"provisioned": report.Count(OutcomeProvisioned),
+		"skipped":     report.Count(OutcomeSkippedNoPK) + report.Count(OutcomeSkippedFilter),
+		"failed":      report.Count(OutcomeFailed),
+		"duration":    time.Since(report.StartedAt),
+	}
+	if report.Count(OutcomeFailed) == 0 {
+		db.log.Info("auditing setup completed without errors", fields)
+	} else {
+		db.log.Warn("auditing setup completed with errors", fields)
+	}
+
+	return err
+}
+
+// RefreshViews rebuilds the delta, snapshot and compare views of every audited
+// table that has been marked stale by an ALTER TABLE since its views were last
+// generated. Triggers and raw audit tables are left untouched.
+func (p *Provisioner) RefreshViews(ctx context.Context, q Querier) error {
+	db, config, err := p.session(ctx, q)
+	if err != nil {
+		return err
+	}
+	config.JSONType, err = getSupportedJSONType(db)
+	if err != nil {
+		return err
+	}
+
+	staleTables, err := getStaleTables(db)
 	if err != nil {
 		return err
 	}
 
-	if errorCounter == 0 {
-		log.Println("auditing setup completed without errors")
+	// the views are granted through audit.grants and filtered through
+	// audit.tenant_members, which only apply creates
+	for _, table := range []string{"audit.grants", "audit.tenant_members"} {
+		var exists bool
+		err = db.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%s does not exist, run apply before refreshing views", table)
+		}
+	}
+
+	failed := failures{continueOnError: config.ContinueOnError, log: db.log}
+	for _, staleTable := range staleTables {
+		err = createAuditViews(staleTable[0], staleTable[1], config, db)
+		if err != nil {
+			if stop := failed.add(staleTable[0], staleTable[1], err); stop != nil {
+				return stop
+			}
+		}
+	}
+
+	fields := Fields{"tables": len(staleTables), "failed": len(failed.tables)}
+	if len(failed.tables) == 0 {
+		db.log.Info("refreshed views of stale tables without errors", fields)
 	} else {
-		log.Println(fmt.Sprintf("auditing setup completed with %d errors", errorCounter))
+		db.log.Warn("refreshed views of stale tables with errors", fields)
 	}
 
-	return nil
+	return failed.err()
 }
 
-func setOwnerRole(db *sql.DB, c *Config) error {
-	if c.OwnerRole != "" {
-		_, err := db.Exec(fmt.Sprintf(`set role='%s'`, c.OwnerRole))
+// ListTables returns every table audit_star considers, sorted by name, along
+// with whether the config selects it for auditing and the rule which did so
+func (p *Provisioner) ListTables(ctx context.Context, q Querier) ([]TableSelection, error) {
+	db, config, err := p.session(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	allSchemas, err := getAllSchemas(db, config)
+	if err != nil {
+		return nil, err
+	}
+
+	allTables, err := getAllTables(db, config, allSchemas)
+	if err != nil {
+		return nil, err
+	}
+
+	var selections []TableSelection
+	for tbl, tableSettings := range filterTables(allTables, config) {
+		schemaTable := strings.SplitN(tbl, ".", 2)
+		selections = append(selections, TableSelection{
+			Schema:   schemaTable[0],
+			Table:    schemaTable[1],
+			Selected: tableSettings.enableTable,
+			Rule:     tableSettings.rule,
+		})
+	}
+
+	sort.Slice(selections, func(i, j int) bool {
+		if selections[i].Schema != selections[j].Schema {
+			return selections[i].Schema < selections[j].Schema
+		}
+		return selections[i].Table < selections[j].Table
+	})
+
+	return selections, nil
+}
+
+// Purge deletes the audit rows older than the retention configured for each
+// selected table as maintenance, which needs maintenance_role. Tables without
+// a retention keep their history forever.
+func (p *Provisioner) Purge(ctx context.Context, q Querier) error {
+	db, config, err := p.session(ctx, q)
+	if err != nil {
 		return err
 	}
-	return nil
+	if config.MaintenanceRole == "" {
+		return errors.New("purge needs maintenance_role to delete audit rows")
+	}
+
+	allSchemas, err := getAllSchemas(db, config)
+	if err != nil {
+		return err
+	}
+
+	allTables, err := getAllTables(db, config, allSchemas)
+	if err != nil {
+		return err
+	}
+
+	failed := failures{continueOnError: config.ContinueOnError, log: db.log}
+	for _, tbl := range enabledTables(filterTables(allTables, config)) {
+		schemaTable := strings.SplitN(tbl, ".", 2)
+		retention := tableOptionsFor(schemaTable[0], schemaTable[1], config).retention
+		if retention == "" {
+			continue
+		}
+
+		err = purgeAuditTable(schemaTable[0], schemaTable[1], retention, db)
+		if err != nil {
+			if stop := failed.add(schemaTable[0], schemaTable[1], err); stop != nil {
+				return stop
+			}
+		}
+	}
+
+	return failed.err()
 }
 
-func setLockTimeout(db *sql.DB, c *Config) error {
-	if c.LockTimeout != "" {
-		_, err := db.Exec(fmt.Sprintf(`set lock_timeout='%s'`, c.LockTimeout))
+// Remove drops the triggers, audit functions and views of every selected
+// table and closes its audit_history entry. The raw audit tables and the
+// history they hold are kept.
+func (p *Provisioner) Remove(ctx context.Context, q Querier) error {
+	db, config, err := p.session(ctx, q)
+	if err != nil {
+		return err
+	}
+	allSchemas, err := getAllSchemas(db, config)
+	if err != nil {
+		return err
+	}
+
+	allTables, err := getAllTables(db, config, allSchemas)
+	if err != nil {
 		return err
 	}
+
+	failed := failures{continueOnError: config.ContinueOnError, log: db.log}
+	for _, tbl := range enabledTables(filterTables(allTables, config)) {
+		schemaTable := strings.SplitN(tbl, ".", 2)
+		err = removeAuditing(schemaTable[0], schemaTable[1], db)
+		if err != nil {
+			if stop := failed.add(schemaTable[0], schemaTable[1], err); stop != nil {
+				return stop
+			}
+		}
+	}
+
+	return failed.err()
+}
+
+// Export writes the raw audit rows of every selected table to w as JSON
+// lines, each holding the database, schema, table and audit row
+func (p *Provisioner) Export(ctx context.Context, q Querier, w io.Writer) error {
+	db, config, err := p.session(ctx, q)
+	if err != nil {
+		return err
+	}
+	allSchemas, err := getAllSchemas(db, config)
+	if err != nil {
+		return err
+	}
+
+	allTables, err := getAllTables(db, config, allSchemas)
+	if err != nil {
+		return err
+	}
+
+	for _, tbl := range enabledTables(filterTables(allTables, config)) {
+		schemaTable := strings.SplitN(tbl, ".", 2)
+		err = exportAuditTable(schemaTable[0], schemaTable[1], db, w)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // returns a slice of schema names in the db
-func getAllSchemas(db *sql.DB, c *Config) ([]string, error) {
+func getAllSchemas(db *session, c *Config) ([]string, error) {
 	query := `SELECT schema_name AS schema
 	FROM information_schema.schemata
 	WHERE schema_name NOT LIKE '%audit%'
@@ -243,7 +729,7 @@ func getAllSchemas(db *sql.DB, c *Config) ([]string, error) {
 
 // returns a map of table names in the schema to be used later for
 // determining which tables have their audit triggers enabled
-func getAllTables(db *sql.DB, c *Config, schemas []string) (map[string]tableSettings, error) {
+func getAllTables(db *session, c *Config, schemas []string) (map[string]tableSettings, error) {
 	allTables := make(map[string]tableSettings)
 	for _, schema := range schemas {
 		tables, err := tablesForSchema(db, c, schema)
@@ -264,7 +750,7 @@ func getAllTables(db *sql.DB, c *Config, schemas []string) (map[string]tableSett
 }
 
 // returns a slice of table names for a given schema
-func tablesForSchema(db *sql.DB, c *Config, schema string) ([]string, error) {
+func tablesForSchema(db *session, c *Config, schema string) ([]string, error) {
 	query := `SELECT relname AS table
 		FROM pg_class
 		JOIN pg_namespace ON pg_namespace.oid = pg_class.relnamespace
@@ -277,7 +763,6 @@ func tablesForSchema(db *sql.DB, c *Config, schema string) ([]string, error) {
 		query += " AND rolname = '" + c.Owner + "'"
 	}
 
-	printQueryIfDebug(query)
 	rows, err := db.Query(query, schema)
 	if err != nil {
 		return nil, err
@@ -297,138 +782,355 @@ func tablesForSchema(db *sql.DB, c *Config, schema string) ([]string, error) {
 	return tables, nil
 }
 
-func filterSchemas(schemas []string, c *Config) []string {
+// returns the schemas which need an _audit_raw schema. when included_tables
+// is set, only schemas holding at least one selected table are returned
+func filterSchemas(schemas []string, tables map[string]tableSettings, c *Config) []string {
 	var filteredSchemas []string
 	for _, schema := range schemas {
-		if isIncludedSchema(schema, c) {
-			if !isExcludedSchema(schema, c) {
-				filteredSchemas = append(filteredSchemas, schema)
-			}
+		if isExcludedSchema(schema, c) {
+			continue
+		}
+
+		if len(c.IncludedTables) > 0 && !hasEnabledTable(schema, tables) {
+			continue
 		}
+
+		filteredSchemas = append(filteredSchemas, schema)
 	}
 	return filteredSchemas
 }
 
-// turn off auditting on specific schemas based on config
-func filterTableSchemas(tables map[string]tableSettings, c *Config) map[string]tableSettings {
-	for table := range tables {
-		if isExcludedSchema(table, c) {
-			tables[table] = tableSettings{
-				enableTable:   false,
-				enableTrigger: false,
-			}
+// returns true if any table of the schema is enabled for auditing
+func hasEnabledTable(schema string, tables map[string]tableSettings) bool {
+	for table, tableSettings := range tables {
+		if tableSettings.enableTable && strings.HasPrefix(table, schema+".") {
+			return true
 		}
 	}
 
-	return tables
+	return false
 }
 
-func isExcludedSchema(table string, c *Config) bool {
-	for _, schema := range c.ExcludedSchemas {
-		if strings.HasPrefix(table, schema) {
-			return true
+// returns the names of the tables enabled for auditing, sorted
+func enabledTables(tables map[string]tableSettings) []string {
+	var names []string
+	for tbl, tableSettings := range tables {
+		if tableSettings.enableTable {
+			names = append(names, tbl)
 		}
 	}
+	sortTableNames(names)
 
-	return false
+	return names
 }
 
 // turn off auditting on specific tables based on config
 func filterTables(tables map[string]tableSettings, c *Config) map[string]tableSettings {
 	for table := range tables {
-		if !isIncludedTable(table, c) {
-			tables[table] = tableSettings{
-				enableTable:   false,
-				enableTrigger: false,
-			}
-		}
-
-		if isExcludedTable(table, c) {
-			tables[table] = tableSettings{
-				enableTable:   false,
-				enableTrigger: false,
-			}
+		enabled, rule := selectTable(table, c)
+		schemaTable := strings.SplitN(table, ".", 2)
+		tables[table] = tableSettings{
+			enableTable:   enabled,
+			enableTrigger: enabled && tableOptionsFor(schemaTable[0], schemaTable[1], c).enableTrigger,
+			rule:          rule,
 		}
 	}
 
 	return tables
 }
 
-func isIncludedSchema(table string, c *Config) bool {
+// decides whether a schema.table is audited and returns the config rule which
+// decided it. exclusions always take precedence over included_tables, and
+// excluded_tables is checked before excluded_schemas
+func selectTable(table string, c *Config) (bool, string) {
+	schema := table[:strings.IndexByte(table, '.')]
+
+	if pattern, ok := matchingPattern(c.ExcludedTables, table); ok {
+		return false, "excluded_tables: " + pattern
+	}
+
+	if pattern, ok := matchingPattern(c.ExcludedSchemas, schema); ok {
+		return false, "excluded_schemas: " + pattern
+	}
+
 	if len(c.IncludedTables) == 0 {
-		return true
+		return true, "included_tables is empty"
 	}
 
-	for _, t := range c.IncludedTables {
-		if idx := strings.IndexByte(t, '.'); idx >= 0 {
-			if table == t[:idx] {
-				return true
-			}
-		}
+	if pattern, ok := matchingPattern(c.IncludedTables, table); ok {
+		return true, "included_tables: " + pattern
 	}
 
-	return false
+	return false, "not matched by included_tables"
 }
 
-func isIncludedTable(table string, c *Config) bool {
-	if len(c.IncludedTables) == 0 {
-		return true
+func isExcludedSchema(schema string, c *Config) bool {
+	_, ok := matchingPattern(c.ExcludedSchemas, schema)
+	return ok
+}
+
+// returns the first pattern which matches name. patterns are checked by
+// checkPatterns when a session starts, so none of them fail here
+func matchingPattern(patterns []string, name string) (string, bool) {
+	for _, pattern := range patterns {
+		if matched, _ := matchPattern(pattern, name); matched {
+			return pattern, true
+		}
 	}
 
-	for _, t := range c.IncludedTables {
-		if table == t {
-			return true
+	return "", false
+}
+
+// returns true if name matches a table or schema pattern from the config.
+// patterns starting with re: are regular expressions matched against the
+// whole name, anything else is a glob as understood by path.Match, so a
+// pattern without wildcards only matches that exact name
+func matchPattern(pattern, name string) (bool, error) {
+	if strings.HasPrefix(pattern, "re:") {
+		re, err := regexp.Compile("^(?:" + strings.TrimPrefix(pattern, "re:") + ")$")
+		if err != nil {
+			return false, err
 		}
+		return re.MatchString(name), nil
 	}
 
-	return false
+	return path.Match(pattern, name)
 }
 
-func isExcludedTable(table string, c *Config) bool {
-	for _, t := range c.ExcludedTables {
-		if table == t {
-			return true
+// returns the first table or schema pattern of the config which is not valid.
+// Validate reports them along with the rest of the config, this keeps them
+// from silently matching nothing when it is not called
+func checkPatterns(c *Config) error {
+	patterns := append(append(append([]string(nil), c.IncludedTables...), c.ExcludedTables...), c.ExcludedSchemas...)
+	for key := range c.Tables {
+		patterns = append(patterns, key)
+	}
+
+	for _, pattern := range patterns {
+		if _, err := matchPattern(pattern, ""); err != nil {
+			return fmt.Errorf("%s: %v", pattern, err)
 		}
 	}
+	return nil
+}
 
-	return false
+// returns the table-specific settings for a given table. every pattern key
+// matching the table is applied in sorted order, then the entry for the exact
+// table name, so the most specific entry wins
+func tableConfig(schema, table string, c *Config) TableConfig {
+	name := schema + "." + table
+
+	var keys []string
+	for key := range c.Tables {
+		if matched, _ := matchPattern(key, name); matched && key != name {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if _, ok := c.Tables[name]; ok {
+		keys = append(keys, name)
+	}
+
+	var tc TableConfig
+	for _, key := range keys {
+		tc.merge(c.Tables[key])
+	}
+
+	return tc
+}
+
+// overwrites the fields of tc which are set in override
+func (tc *TableConfig) merge(override TableConfig) {
+	if override.Security != "" {
+		tc.Security = override.Security
+	}
+	if override.LogClientQuery != nil {
+		tc.LogClientQuery = override.LogClientQuery
+	}
+	if override.ValueMaxLength != 0 {
+		tc.ValueMaxLength = override.ValueMaxLength
+	}
+	if override.QueryMaxLength != 0 {
+		tc.QueryMaxLength = override.QueryMaxLength
+	}
+	if override.ExcludedColumns != nil {
+		tc.ExcludedColumns = override.ExcludedColumns
+	}
+	if override.Grantee != "" {
+		tc.Grantee = override.Grantee
+	}
+	if override.Retention != "" {
+		tc.Retention = override.Retention
+	}
+	if override.Trigger != "" {
+		tc.Trigger = override.Trigger
+	}
+	if override.StoreFullRow != nil {
+		tc.StoreFullRow = override.StoreFullRow
+	}
+	if override.SkipNoopUpdates != nil {
+		tc.SkipNoopUpdates = override.SkipNoopUpdates
+	}
+	if override.IgnoredColumns != nil {
+		tc.IgnoredColumns = override.IgnoredColumns
+	}
+	if override.HashChain != nil {
+		tc.HashChain = override.HashChain
+	}
+	if override.PersonalColumns != nil {
+		tc.PersonalColumns = override.PersonalColumns
+	}
+	if override.RowSecurity != nil {
+		tc.RowSecurity = override.RowSecurity
+	}
+	if override.TenantColumn != "" {
+		tc.TenantColumn = override.TenantColumn
+	}
+}
+
+// returns the settings a table is provisioned with, taking the global
+// settings for anything its tables entries leave unset
+func tableOptionsFor(schema, table string, c *Config) tableOptions {
+	tc := tableConfig(schema, table, c)
+
+	opts := tableOptions{
+		security:        "definer",
+		logClientQuery:  c.LogClientQuery,
+		valueMaxLength:  500,
+		queryMaxLength:  1000,
+		excludedColumns: tc.ExcludedColumns,
+		grantee:         c.Grantee,
+		retention:       c.Retention,
+		enableTrigger:   tc.Trigger != "disabled",
+		skipNoopUpdates: c.SkipNoopUpdates,
+		ignoredColumns:  tc.IgnoredColumns,
+		hashChain:       c.HashChain,
+		personalColumns: tc.PersonalColumns,
+		rowSecurity:     c.RowSecurity,
+		tenantColumn:    c.TenantColumn,
+		tenantSetting:   DefaultTenantSetting,
+	}
+
+	if c.Security != "" {
+		opts.security = c.Security
+	}
+	if c.ValueMaxLength != 0 {
+		opts.valueMaxLength = c.ValueMaxLength
+	}
+	if c.QueryMaxLength != 0 {
+		opts.queryMaxLength = c.QueryMaxLength
+	}
+	if c.TenantSetting != "" {
+		opts.tenantSetting = c.TenantSetting
+	}
+
+	if tc.Security != "" {
+		opts.security = tc.Security
+	}
+	if tc.LogClientQuery != nil {
+		opts.logClientQuery = *tc.LogClientQuery
+	}
+	if tc.ValueMaxLength != 0 {
+		opts.valueMaxLength = tc.ValueMaxLength
+	}
+	if tc.QueryMaxLength != 0 {
+		opts.queryMaxLength = tc.QueryMaxLength
+	}
+	if tc.Grantee != "" {
+		opts.grantee = tc.Grantee
+	}
+	if tc.Retention != "" {
+		opts.retention = tc.Retention
+	}
+	if tc.StoreFullRow != nil {
+		opts.storeFullRow = *tc.StoreFullRow
+	}
+	if tc.SkipNoopUpdates != nil {
+		opts.skipNoopUpdates = *tc.SkipNoopUpdates
+	}
+	if tc.HashChain != nil {
+		opts.hashChain = *tc.HashChain
+	}
+	if tc.RowSecurity != nil {
+		opts.rowSecurity = *tc.RowSecurity
+	}
+	if tc.TenantColumn != "" {
+		opts.tenantColumn = tc.TenantColumn
+	}
+
+	// updates which only change ignored columns are not audited, and the
+	// updated_by trigger changes its column along with them
+	if column, _, _ := c.UpdatedBy.column(); c.UpdatedBy.Trigger && len(opts.ignoredColumns) > 0 && !contains(opts.ignoredColumns, column) {
+		opts.ignoredColumns = append(append([]string(nil), opts.ignoredColumns...), column)
+	}
+
+	return opts
 }
 
 // loops over each table in the db and sets up auditting for that table
-func setAuditing(tables map[string]tableSettings, c *Config, db *sql.DB) error {
-	for tbl, tableSettings := range tables {
-		if tableSettings.enableTable {
-			schemaTable := strings.Split(tbl, ".")
-			schema := schemaTable[0]
-			table := schemaTable[1]
-			validPrimaryKey, err := hasValidPrimaryKey(schema, table, db)
-			if err != nil {
-				return err
-			}
+func setAuditing(tables map[string]tableSettings, c *Config, db *session, report *RunReport) error {
+	names := make([]string, 0, len(tables))
+	for tbl := range tables {
+		names = append(names, tbl)
+	}
+	sortTableNames(names)
+
+	failed := failures{continueOnError: c.ContinueOnError, log: db.log}
+	for _, tbl := range names {
+		tableSettings := tables[tbl]
+		schemaTable := strings.SplitN(tbl, ".", 2)
+		schema := schemaTable[0]
+		table := schemaTable[1]
+		outcome := TableOutcome{Schema: schema, Table: table, Rule: tableSettings.rule}
+
+		if !tableSettings.enableTable {
+			outcome.Outcome = OutcomeSkippedFilter
+			report.Tables = append(report.Tables, outcome)
+			continue
+		}
+
+		start := time.Now()
+		validPrimaryKey, err := hasValidPrimaryKey(schema, table, db)
+		if err == nil && !validPrimaryKey {
+			db.log.Info("SKIPPED table due to zero or multi-field PK", Fields{"schema": schema, "table": table, "step": "primary_key"})
+			outcome.Outcome = OutcomeSkippedNoPK
+			report.Tables = append(report.Tables, outcome)
+			continue
+		}
+
+		if err == nil && c.ViewsOnly {
+			err = auditViewsOnly(schema, table, tableSettings.enableTrigger, c, db)
+		} else if err == nil {
+			err = audit(schema, table, tableSettings.enableTrigger, c, db)
+		}
+
+		outcome.Duration = time.Since(start)
+		if err != nil {
+			outcome.Outcome = OutcomeFailed
+			outcome.Error = err.Error()
+			report.Tables = append(report.Tables, outcome)
 
-			if validPrimaryKey {
-				if c.ViewsOnly {
-					err := auditViewsOnly(schema, table, tableSettings.enableTrigger, c, db)
-					if err != nil {
-						return err
-					}
-				} else {
-					err := audit(schema, table, tableSettings.enableTrigger, c, db)
-					if err != nil {
-						return err
-					}
-				}
+			if stop := failed.add(schema, table, err); stop != nil {
+				return stop
 			}
+			continue
 		}
+
+		outcome.Outcome = OutcomeProvisioned
+		report.Tables = append(report.Tables, outcome)
+
+		db.log.Info("provisioned table", Fields{"schema": schema, "table": table, "step": "table", "duration": outcome.Duration})
 	}
 
-	return nil
+	return failed.err()
 }
 
 // sets up audting for a given table, as configured in the config file
 // func audit(schema, table, security string, logging, trigger bool, db *sql.DB) error {
-func audit(schema, table string, trigger bool, c *Config, db *sql.DB) error {
-	err := addColToTable(schema, table, "updated_by", "varchar(50)", db)
+func audit(schema, table string, trigger bool, c *Config, db *session) error {
+	opts := tableOptionsFor(schema, table, c)
+
+	err := addUpdatedByColumn(schema, table, c, db)
 	if err != nil {
 		return err
 	}
@@ -449,116 +1151,179 @@ func audit(schema, table string, trigger bool, c *Config, db *sql.DB) error {
 		return err
 	}
 
-	err = addColToTable(auditSchema, table+"_audit", "changed_by", "varchar(50)", db)
+	err = addColToTable(auditSchema, table+"_audit", "changed_by", "text", db)
 	if err != nil {
 		return err
 	}
 
-	tablesToGrant := []string{
-		"\"" + auditSchema + "\".\"" + table + "_audit\"",
-	}
-	err = grantSelectOnTable(db, c, tablesToGrant)
+	err = widenChangedBy(schema, table, db)
 	if err != nil {
 		return err
 	}
 
-	err = createAuditIndex(auditSchema, table, db)
+	if len(c.ActorSources) > 0 {
+		err = addColToTable(auditSchema, table+"_audit", "actor_context", "jsonb", db)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = addColToTable(auditSchema, table+"_audit", "after_change", c.JSONType, db)
 	if err != nil {
 		return err
 	}
 
-	err = createAuditFunction(schema, table, c.JSONType, c.Security, c.LogClientQuery, db)
+	err = setHashChain(schema, table, opts.hashChain, db)
 	if err != nil {
 		return err
 	}
 
-	err = createAuditTrigger(schema, table, trigger, db)
+	if opts.rowSecurity {
+		err = addColToTable(auditSchema, table+"_audit", "tenant", "text", db)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = grantRawTable(schema, table, opts, c, db)
 	if err != nil {
 		return err
 	}
 
-	err = createViewAuditSchema(schema, db)
+	err = setRowSecurity(schema, table, opts, c, db)
 	if err != nil {
 		return err
 	}
 
-	err = grantUsageOnSchemas(db, c, []string{schema})
+	err = createAuditIndex(auditSchema, table, db)
 	if err != nil {
 		return err
 	}
 
-	tableCols, err := tableColumns(schema, table, db)
+	err = createAuditFunction(schema, table, c, db)
 	if err != nil {
 		return err
 	}
 
-	primaryKeyCol := getPrimaryKeyCol(tableCols)
-
-	err = createAuditDeltaView(schema, table, c.Grantee, tableCols, primaryKeyCol, db)
+	err = createAuditTrigger(schema, table, trigger, db)
 	if err != nil {
 		return err
 	}
 
-	err = createAuditSnapshotView(schema, table, c.Grantee, tableCols, primaryKeyCol, db)
+	err = setUpdatedByTrigger(schema, table, c, db)
 	if err != nil {
 		return err
 	}
 
-	err = createAuditCompareView(schema, table, c.Grantee, tableCols, primaryKeyCol, db)
+	err = createViewAuditSchema(schema, db)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return createAuditViews(schema, table, c, db)
 }
 
 // sets up audting for a given table, as configured in the config file
-func auditViewsOnly(schema, table string, trigger bool, c *Config, db *sql.DB) error {
-	err := addColToTable(schema, table, "updated_by", "varchar(50)", db)
+func auditViewsOnly(schema, table string, trigger bool, c *Config, db *session) error {
+	err := addUpdatedByColumn(schema, table, c, db)
 	if err != nil {
 		return err
 	}
 
+	return createAuditViews(schema, table, c, db)
+}
+
+// (re)creates the delta, snapshot and compare views for a given table from
+// its current columns and clears any stale mark left by the ALTER TABLE
+// event trigger
+func createAuditViews(schema, table string, c *Config, db *session) error {
 	tableCols, err := tableColumns(schema, table, db)
 	if err != nil {
 		return err
 	}
 
 	primaryKeyCol := getPrimaryKeyCol(tableCols)
+	opts := tableOptionsFor(schema, table, c)
 
-	err = createAuditDeltaView(schema, table, c.Grantee, tableCols, primaryKeyCol, db)
+	// audit tables provisioned before after_change existed get the old views
+	fullRow, err := hasColumn(schema+"_audit_raw", table+"_audit", "after_change", db)
 	if err != nil {
 		return err
 	}
 
-	err = createAuditSnapshotView(schema, table, c.Grantee, tableCols, primaryKeyCol, db)
+	rowFilter, err := viewRowFilter(schema, table, opts, db)
 	if err != nil {
 		return err
 	}
 
-	err = createAuditCompareView(schema, table, c.Grantee, tableCols, primaryKeyCol, db)
+	err = createAuditDeltaView(schema, table, c.JSONType, fullRow, tableCols, primaryKeyCol, rowFilter, db)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	err = createAuditSnapshotView(schema, table, c.JSONType, fullRow, tableCols, primaryKeyCol, rowFilter, db)
+	if err != nil {
+		return err
+	}
+
+	err = createAuditCompareView(schema, table, c.JSONType, fullRow, tableCols, primaryKeyCol, rowFilter, db)
+	if err != nil {
+		return err
+	}
+
+	err = grantViews(schema, table, opts, c, db)
+	if err != nil {
+		return err
+	}
+
+	return clearStaleViews(schema, table, db)
+}
+
+// returns a TEXT[] literal holding the given values
+func sqlTextArray(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = "'" + strings.Replace(value, "'", "''", -1) + "'"
+	}
+
+	return "ARRAY[" + strings.Join(quoted, ", ") + "]::TEXT[]"
 }
 
 // helper method to DRY up the code that parses a query template using data
-func mustParseQuery(query string, data map[string]interface{}) string {
-	printQueryIfDebug(query)
-	t := template.Must(template.New("template").Parse(query))
+func parseQuery(query string, data map[string]interface{}) (string, error) {
+	t, err := template.New("template").Parse(query)
+	if err != nil {
+		return "", err
+	}
+
 	buf := &bytes.Buffer{}
 	if err := t.Execute(buf, data); err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
-	return buf.String()
+	return buf.String(), nil
+}
+
+// builds a statement out of several query templates, keeping the first
+// error so that it only needs to be checked once the statement is complete
+type queryBuilder struct {
+	query string
+	err   error
+}
+
+func (b *queryBuilder) add(query string, data map[string]interface{}) {
+	if b.err != nil {
+		return
+	}
+
+	var part string
+	part, b.err = parseQuery(query, data)
+	b.query += part
 }
 
 // used to check that a setting exists in the db before proceeding
 // specifically used to check that audit_star.changed_by field is set
-func ensureSettingExists(setting string, db *sql.DB) error {
+func ensureSettingExists(setting string, db *session) error {
 	query := `DO
 		$$
 		BEGIN
@@ -570,18 +1335,17 @@ func ensureSettingExists(setting string, db *sql.DB) error {
 		END;
 		$$
 		LANGUAGE plpgsql;`
-	printQueryIfDebug(fmt.Sprintf(query, setting))
 	_, err := db.Exec(fmt.Sprintf(query, setting))
 	if err != nil {
 		return err
 	}
 
-	log.Println(setting, "found")
+	db.log.Info("setting found", Fields{"setting": setting})
 	return nil
 }
 
 // creates the audit schema
-func createAuditSchema(db *sql.DB) error {
+func createAuditSchema(db *session) error {
 	query := `DO
 		$$
 		BEGIN
@@ -595,17 +1359,16 @@ func createAuditSchema(db *sql.DB) error {
 		END;
 		$$
 		LANGUAGE plpgsql;`
-	printQueryIfDebug(query)
 	_, err := db.Exec(query)
 	if err != nil {
 		return err
 	}
-	log.Println("audit schema created")
+	db.log.Info("audit schema created", Fields{"step": "audit_schema"})
 	return nil
 }
 
 // creates the audit.audit_history table
-func createAuditAuditingTable(db *sql.DB) error {
+func createAuditAuditingTable(db *session) error {
 	query := `CREATE TABLE IF NOT EXISTS audit.audit_history(
 		audit_history_id SERIAL PRIMARY KEY,
 		schema_name NAME NOT NULL,
@@ -614,38 +1377,275 @@ func createAuditAuditingTable(db *sql.DB) error {
 		end_time TIMESTAMPTZ,
 		CONSTRAINT uniq UNIQUE(schema_name, table_name, start_time)
 	)`
-	printQueryIfDebug(query)
 	_, err := db.Exec(query)
 	if err != nil {
 		return err
 	}
 
-	log.Println("audit auditing table created")
+	db.log.Info("audit auditing table created", Fields{"step": "audit_schema"})
 	return nil
 }
 
-func createNoDMLAuditFunction(db *sql.DB) error {
+// creates the function behind the triggers which stop updates, deletes and
+// truncates of the audit tables. members of maintenance_role may still make
+// them once they set audit_star.maintenance_reason, and each change is
+// recorded in audit.maintenance_log, which the function writes to as its
+// owner so that the maintainers cannot add entries of their own
+func createNoDMLAuditFunction(db *session, c *Config) error {
 	query := `CREATE OR REPLACE FUNCTION audit.no_dml_on_audit_table()
 		RETURNS TRIGGER AS
 		$$
+		DECLARE
+			reason TEXT = NULLIF(current_setting('audit_star.maintenance_reason', true), '');
+			-- current_user is the owner of the function here, the role of the
+			-- caller is the one it set, or the one it connected as
+			invoker NAME = COALESCE(NULLIF(current_setting('role'), 'none'), session_user);
 		BEGIN
+			IF reason IS NOT NULL AND {{.maintenanceRole}} <> '' AND pg_has_role(invoker, {{.maintenanceRole}}, 'MEMBER') THEN
+				INSERT INTO audit.maintenance_log(performed_by, session_user_name, reason, operation, schema_name, table_name, old_row, new_row)
+				VALUES(invoker, session_user, reason, TG_OP, TG_TABLE_SCHEMA, TG_TABLE_NAME,
+					-- erasures and purges keep the data they remove out of the log
+					CASE WHEN TG_LEVEL = 'ROW' AND current_setting('audit_star.log_old_rows', true) IS DISTINCT FROM 'off' THEN to_jsonb(OLD) END,
+					CASE WHEN TG_OP = 'UPDATE' THEN to_jsonb(NEW) END);
+
+				IF TG_LEVEL = 'STATEMENT' THEN
+					RETURN NULL;
+				ELSIF TG_OP = 'UPDATE' THEN
+					RETURN NEW;
+				END IF;
+				RETURN OLD;
+			END IF;
+
 			RAISE EXCEPTION 'No common-case updates/deletes/truncates allowed on audit table';
 			RETURN NULL;
 		END;
 		$$
-		LANGUAGE plpgsql;`
-	printQueryIfDebug(query)
+		LANGUAGE plpgsql
+		SECURITY DEFINER
+		SET search_path = pg_catalog, pg_temp
+		SET TimeZone = 'UTC'
+		SET bytea_output = 'hex';`
+
+	query, err := parseQuery(query, map[string]interface{}{
+		"maintenanceRole": "'" + strings.Replace(c.MaintenanceRole, "'", "''", -1) + "'",
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	db.log.Info("no-DML audit function created", Fields{"step": "audit_schema"})
+	return nil
+}
+
+// creates the audit.stale_views table, which lists the audited tables whose
+// views no longer match their columns
+func createStaleViewsTable(db *session) error {
+	query := `CREATE TABLE IF NOT EXISTS audit.stale_views(
+		schema_name NAME NOT NULL,
+		table_name NAME NOT NULL,
+		marked_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY(schema_name, table_name)
+	)`
+	_, err := db.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	db.log.Info("stale views table created", Fields{"step": "audit_schema"})
+	return nil
+}
+
+// creates the event triggers which keep track of schema changes on audited
+// tables. event triggers can only be created by superusers, so they are
+// skipped with a warning otherwise
+func createEventTriggers(db *session) error {
+	isSuperuser, err := currentUserIsSuperuser(db)
+	if err != nil {
+		return err
+	}
+
+	if !isSuperuser {
+		db.log.Warn("not connected as a superuser, skipping stale views and DDL history event triggers", Fields{"step": "event_triggers"})
+		return nil
+	}
+
+	err = createStaleViewsEventTrigger(db)
+	if err != nil {
+		return err
+	}
+
+	return createDDLHistoryEventTrigger(db)
+}
+
+// creates the event trigger which marks an audited table's views as stale
+// whenever the table is altered
+func createStaleViewsEventTrigger(db *session) error {
+	query := `CREATE OR REPLACE FUNCTION audit.mark_stale_views()
+		RETURNS EVENT_TRIGGER AS
+		$$
+		BEGIN
+			INSERT INTO audit.stale_views(schema_name, table_name, marked_at)
+			SELECT DISTINCT pg_namespace.nspname, pg_class.relname, now()
+			FROM pg_event_trigger_ddl_commands() cmd
+			JOIN pg_class ON pg_class.oid = cmd.objid
+			JOIN pg_namespace ON pg_namespace.oid = pg_class.relnamespace
+			JOIN pg_trigger ON pg_trigger.tgrelid = pg_class.oid AND pg_trigger.tgname = 'row_audit_star'
+			WHERE cmd.classid = 'pg_class'::regclass
+			ON CONFLICT (schema_name, table_name) DO UPDATE SET marked_at = EXCLUDED.marked_at;
+		END;
+		$$
+		LANGUAGE plpgsql
+		SECURITY DEFINER;
+
+		DROP EVENT TRIGGER IF EXISTS audit_star_mark_stale_views;
+		CREATE EVENT TRIGGER audit_star_mark_stale_views
+		ON ddl_command_end
+		WHEN TAG IN ('ALTER TABLE')
+		EXECUTE PROCEDURE audit.mark_stale_views();`
 	_, err := db.Exec(query)
 	if err != nil {
 		return err
 	}
 
-	log.Println("no-DML audit function created")
+	db.log.Info("stale views event trigger created", Fields{"step": "event_triggers"})
+	return nil
+}
+
+// creates the audit.ddl_history table, which records schema changes made to
+// objects in audited schemas
+func createDDLHistoryTable(db *session) error {
+	query := `CREATE TABLE IF NOT EXISTS audit.ddl_history(
+			ddl_history_id BIGSERIAL PRIMARY KEY,
+			command_tag TEXT NOT NULL,
+			object_type TEXT,
+			schema_name NAME,
+			object_identity TEXT,
+			command TEXT,
+			db_user TEXT NOT NULL,
+			changed_by TEXT,
+			changed_at TIMESTAMPTZ NOT NULL
+		);
+
+		DROP TRIGGER IF EXISTS no_dml_on_audit_table ON audit.ddl_history;
+			CREATE TRIGGER no_dml_on_audit_table
+			BEFORE UPDATE OR DELETE ON audit.ddl_history
+			FOR EACH ROW
+			EXECUTE PROCEDURE audit.no_dml_on_audit_table();
+
+			DROP TRIGGER IF EXISTS no_truncate_on_audit ON audit.ddl_history;
+			CREATE TRIGGER no_truncate_on_audit
+			BEFORE TRUNCATE ON audit.ddl_history
+			FOR EACH STATEMENT
+			EXECUTE PROCEDURE audit.no_dml_on_audit_table();`
+	err := db.inTx(func(tx *session) error {
+		_, err := tx.Exec(query)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	db.log.Info("DDL history table created", Fields{"step": "audit_schema"})
 	return nil
 }
 
+// creates the event triggers which record DDL on objects in audited schemas,
+// i.e. schemas which have a matching _audit_raw schema. dropped objects are
+// only reported by sql_drop, except for ALTER TABLE which ddl_command_end
+// already covers
+func createDDLHistoryEventTrigger(db *session) error {
+	query := `CREATE OR REPLACE FUNCTION audit.log_ddl_history()
+		RETURNS EVENT_TRIGGER AS
+		$$
+		BEGIN
+			IF (TG_EVENT = 'ddl_command_end') THEN
+				INSERT INTO audit.ddl_history(command_tag, object_type, schema_name, object_identity, command, db_user, changed_by, changed_at)
+				SELECT cmd.command_tag, cmd.object_type, cmd.schema_name, cmd.object_identity, current_query(), session_user::TEXT, current_setting('audit_star.changed_by', true), now()
+				FROM pg_event_trigger_ddl_commands() cmd
+				WHERE EXISTS (SELECT 1 FROM pg_namespace WHERE nspname = cmd.schema_name || '_audit_raw');
+			ELSIF (TG_EVENT = 'sql_drop' AND TG_TAG <> 'ALTER TABLE') THEN
+				INSERT INTO audit.ddl_history(command_tag, object_type, schema_name, object_identity, command, db_user, changed_by, changed_at)
+				SELECT TG_TAG, obj.object_type, obj.schema_name, obj.object_identity, current_query(), session_user::TEXT, current_setting('audit_star.changed_by', true), now()
+				FROM pg_event_trigger_dropped_objects() obj
+				WHERE obj.original
+				AND EXISTS (SELECT 1 FROM pg_namespace WHERE nspname = obj.schema_name || '_audit_raw');
+			END IF;
+		END;
+		$$
+		LANGUAGE plpgsql
+		SECURITY DEFINER;
+
+		DROP EVENT TRIGGER IF EXISTS audit_star_ddl_history;
+		CREATE EVENT TRIGGER audit_star_ddl_history
+		ON ddl_command_end
+		EXECUTE PROCEDURE audit.log_ddl_history();
+
+		DROP EVENT TRIGGER IF EXISTS audit_star_ddl_history_drop;
+		CREATE EVENT TRIGGER audit_star_ddl_history_drop
+		ON sql_drop
+		EXECUTE PROCEDURE audit.log_ddl_history();`
+	_, err := db.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	db.log.Info("DDL history event triggers created", Fields{"step": "event_triggers"})
+	return nil
+}
+
+// returns true if the current role is allowed to create event triggers
+func currentUserIsSuperuser(db *session) (bool, error) {
+	query := `SELECT rolsuper FROM pg_roles WHERE rolname = current_user`
+
+	var isSuperuser bool
+	err := db.QueryRow(query).Scan(&isSuperuser)
+	if err != nil {
+		return false, err
+	}
+
+	return isSuperuser, nil
+}
+
+// returns the schema and table names of every existing table marked stale
+func getStaleTables(db *session) ([][]string, error) {
+	query := `SELECT schema_name, table_name
+		FROM audit.stale_views
+		WHERE to_regclass(format('%I.%I', schema_name, table_name)) IS NOT NULL
+		ORDER BY schema_name, table_name`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schema, table string
+	var tables [][]string
+	for rows.Next() {
+		err := rows.Scan(&schema, &table)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, []string{schema, table})
+	}
+
+	return tables, rows.Err()
+}
+
+// removes the stale mark of a table once its views have been regenerated
+func clearStaleViews(schema, table string, db *session) error {
+	query := `DELETE FROM audit.stale_views WHERE schema_name = $1 AND table_name = $2`
+	_, err := db.Exec(query, schema, table)
+	return err
+}
+
 // adds a column of a given type to a db's schema.table
-func addColToTable(schema, table, column, colType string, db *sql.DB) error {
+func addColToTable(schema, table, column, colType string, db *session) error {
+	start := time.Now()
 	data := map[string]interface{}{
 		"schema":  schema,
 		"table":   table,
@@ -664,24 +1664,24 @@ func addColToTable(schema, table, column, colType string, db *sql.DB) error {
 		END;
 		$$`
 
-	_, err := db.Exec(mustParseQuery(query, data))
+	query, err := parseQuery(query, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(query)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("added %s column to %s.%s\n", column, schema, table)
+	db.log.Info("added column", Fields{"schema": schema, "table": table, "step": "add_column", "column": column, "duration": time.Since(start)})
 	return nil
 }
 
 // helper function used below to make sure we don't create audit schemas
 // for excluded schemas
 func contains(a []string, s string) bool {
-	fmt.Println("inside contains function")
-	fmt.Println("a:", a)
-	fmt.Println("s:", s)
-	for index, item := range a {
-		fmt.Println("index:", index)
-		fmt.Println("item:", item)
+	for _, item := range a {
 		if item == s {
 			return true
 		}
@@ -691,67 +1691,38 @@ func contains(a []string, s string) bool {
 }
 
 // creates _audit_raw schemas for all non-excluded schemas
-func createRawAuditSchemas(db *sql.DB, c *Config, schemas []string) error {
+func createRawAuditSchemas(db *session, c *Config, schemas []string) error {
 	for _, schema := range schemas {
-		query := `DO
-			$$
-			BEGIN
-				IF NOT EXISTS (
-						SELECT 1
-						FROM information_schema.schemata
-						WHERE schema_name = '%s_audit_raw'
-				) THEN
-					CREATE SCHEMA "%s_audit_raw";
-				END IF;
-			END;
-			$$
-			LANGUAGE plpgsql;`
-		printQueryIfDebug(fmt.Sprintf(query, schema, schema))
-		_, err := db.Exec(fmt.Sprintf(query, schema, schema))
-		if err != nil {
-			return err
-		}
-		log.Printf("%s_audit_raw created\n", schema)
-	}
-
-	return nil
-}
-
-func grantUsageOnSchemas(db *sql.DB, c *Config, schemas []string) error {
-	for _, schema := range schemas {
-		query := `GRANT USAGE ON SCHEMA "%s_audit_raw" TO %s;`
-		_, err := db.Exec(fmt.Sprintf(query, schema, c.Grantee))
-		if err != nil {
-			return err
-		}
-		log.Printf("granted usage on schema %s_audit_raw to %s\n", schema, c.Grantee)
-	}
-
-	return nil
-}
-
-func grantSelectOnTable(db *sql.DB, c *Config, tables []string) error {
-	for _, table := range tables {
-		query := `GRANT SELECT ON TABLE %s TO %s;`
-		printQueryIfDebug(fmt.Sprintf(query, table, c.Grantee))
-		_, err := db.Exec(fmt.Sprintf(query, table, c.Grantee))
+		query := `DO
+			$$
+			BEGIN
+				IF NOT EXISTS (
+						SELECT 1
+						FROM information_schema.schemata
+						WHERE schema_name = '%s_audit_raw'
+				) THEN
+					CREATE SCHEMA "%s_audit_raw";
+				END IF;
+			END;
+			$$
+			LANGUAGE plpgsql;`
+		_, err := db.Exec(fmt.Sprintf(query, schema, schema))
 		if err != nil {
 			return err
 		}
-		log.Printf("granted select on table to %s\n", c.Grantee)
+		db.log.Info("raw audit schema created", Fields{"schema": schema, "step": "raw_schema"})
 	}
 
 	return nil
 }
 
 // queries the db to determine which JSON type is supported by the host db
-func getSupportedJSONType(db *sql.DB) (string, error) {
+func getSupportedJSONType(db *session) (string, error) {
 	query := `SELECT EXISTS (
 		SELECT 1
 		FROM pg_type
 		WHERE typname LIKE 'jsonb'
 	) AS exists`
-	printQueryIfDebug(query)
 	row := db.QueryRow(query)
 
 	var jsonBExists bool
@@ -761,16 +1732,81 @@ func getSupportedJSONType(db *sql.DB) (string, error) {
 	}
 
 	if jsonBExists {
-		log.Println("db supports jsonb")
+		db.log.Info("db supports jsonb", nil)
 		return "jsonb", nil
 	}
 
-	log.Println("db does not support jsonb, will use json instead")
+	db.log.Info("db does not support jsonb, will use json instead", nil)
 	return "json", nil
 }
 
+// makes sure the configured payload engine is known and usable on this db.
+// hstore stays the default so that existing deployments keep their format
+func checkPayloadEngine(c *Config) error {
+	switch c.PayloadEngine {
+	case "":
+		c.PayloadEngine = "hstore"
+	case "hstore":
+	case "jsonb":
+		if c.JSONType != "jsonb" {
+			return fmt.Errorf("payload_engine jsonb requires a database which supports jsonb")
+		}
+	default:
+		return fmt.Errorf("unknown payload_engine %q, expected hstore or jsonb", c.PayloadEngine)
+	}
+
+	return nil
+}
+
+// creates the function used by the views to turn a json array back into a
+// postgres array literal. legacy hstore payloads already hold array literals
+// as strings, so those are returned untouched
+func createJSONArrayTextFunction(db *session, c *Config) error {
+	if c.JSONType != "jsonb" {
+		return nil
+	}
+
+	query := `CREATE OR REPLACE FUNCTION audit.jsonb_array_text(payload JSONB)
+		RETURNS TEXT AS
+		$$
+			SELECT CASE jsonb_typeof(payload)
+				WHEN 'array' THEN '{' || COALESCE((
+					SELECT string_agg(
+						CASE jsonb_typeof(elements.element)
+							WHEN 'null' THEN 'NULL'
+							WHEN 'array' THEN audit.jsonb_array_text(elements.element)
+							ELSE '"' || replace(replace(elements.element #>> '{}', '\', '\\'), '"', '\"') || '"'
+						END, ',' ORDER BY elements.idx)
+					FROM jsonb_array_elements(payload) WITH ORDINALITY elements(element, idx)
+				), '') || '}'
+				ELSE payload #>> '{}'
+			END
+		$$
+		LANGUAGE sql
+		IMMUTABLE;`
+	_, err := db.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	db.log.Info("json array text function created", Fields{"step": "audit_schema"})
+	return nil
+}
+
+// returns the expression which reads a column out of a json payload and casts
+// it back to the column's type. with jsonb, arrays are stored as json arrays
+// and have to go through audit.jsonb_array_text to be cast
+func jsonColumnValue(source, colName, dataType, jsonType string) string {
+	if jsonType == "jsonb" && strings.HasSuffix(dataType, "[]") {
+		return fmt.Sprintf("audit.jsonb_array_text((%s -> '%s')::jsonb)::%s", source, colName, dataType)
+	}
+
+	return fmt.Sprintf("(%s ->> '%s')::%s", source, colName, dataType)
+}
+
 // creates the audit table for a given table
-func createAuditTable(auditSchema, table, jsonType string, db *sql.DB) error {
+func createAuditTable(auditSchema, table, jsonType string, db *session) error {
+	start := time.Now()
 	data := map[string]interface{}{
 		"auditSchema": auditSchema,
 		"table":       table,
@@ -792,7 +1828,6 @@ func createAuditTable(auditSchema, table, jsonType string, db *sql.DB) error {
 
 		ALTER TABLE "{{.auditSchema}}"."{{.table}}_audit" ALTER COLUMN client_query DROP NOT NULL;
 
-		BEGIN;
 			DROP TRIGGER IF EXISTS no_dml_on_audit_table ON "{{.auditSchema}}"."{{.table}}_audit";
 			CREATE TRIGGER no_dml_on_audit_table
 			BEFORE UPDATE OR DELETE ON "{{.auditSchema}}"."{{.table}}_audit"
@@ -803,20 +1838,174 @@ func createAuditTable(auditSchema, table, jsonType string, db *sql.DB) error {
 			CREATE TRIGGER no_truncate_on_audit
 			BEFORE TRUNCATE ON "{{.auditSchema}}"."{{.table}}_audit"
 			FOR EACH STATEMENT
-			EXECUTE PROCEDURE audit.no_dml_on_audit_table();
-		COMMIT;`
+			EXECUTE PROCEDURE audit.no_dml_on_audit_table();`
+
+	query, err := parseQuery(query, data)
+	if err != nil {
+		return err
+	}
+
+	err = db.inTx(func(tx *session) error {
+		_, err := tx.Exec(query)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	db.log.Info("created audit table", Fields{"schema": strings.TrimSuffix(auditSchema, "_audit_raw"), "table": table, "step": "audit_table", "duration": time.Since(start)})
+	return nil
+}
+
+// deletes the rows of an audit table older than the retention interval as
+// maintenance, so the no-DML trigger lets them through and records each of
+// them in audit.maintenance_log without its content. hash chained rows are
+// deleted by chain_seq up to the oldest one retained, so the rest of the
+// chain has no gaps however changed_at is ordered, and the head of the chain
+// is always kept for the next row to link to
+func purgeAuditTable(schema, table, retention string, db *session) error {
+	start := time.Now()
+	auditTable := fmt.Sprintf(`"%s_audit_raw"."%s_audit"`, schema, table)
+
+	var exists bool
+	err := db.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, auditTable).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	chained, err := hasColumn(schema+"_audit_raw", table+"_audit", "chain_seq", db)
+	if err != nil {
+		return err
+	}
+
+	purge := fmt.Sprintf(`DELETE FROM %s WHERE changed_at < now() - $1::INTERVAL`, auditTable)
+	if chained {
+		purge = fmt.Sprintf(`DELETE FROM %[1]s WHERE CASE WHEN chain_seq IS NULL THEN changed_at < now() - $1::INTERVAL
+			ELSE chain_seq < COALESCE(
+				(SELECT min(chain_seq) FROM %[1]s WHERE chain_seq IS NOT NULL AND changed_at >= now() - $1::INTERVAL),
+				(SELECT max(chain_seq) FROM %[1]s)
+			) END`, auditTable)
+	}
+
+	var deleted int64
+	err = maintain(db, "retention "+retention, func(tx *session) error {
+		_, err := tx.Exec(`SELECT set_config('audit_star.log_old_rows', 'off', true)`)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(purge, retention)
+		if err != nil {
+			return err
+		}
+
+		deleted, err = result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`SELECT set_config('audit_star.log_old_rows', '', true)`)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	db.log.Info("purged audit rows", Fields{"schema": schema, "table": table, "step": "purge", "rows": deleted, "retention": retention, "duration": time.Since(start)})
+	return nil
+}
+
+// drops everything apply created for a table except its raw audit table
+func removeAuditing(schema, table string, db *session) error {
+	start := time.Now()
+	data := map[string]interface{}{
+		"schema": schema,
+		"table":  table,
+	}
+
+	query := `DROP TRIGGER IF EXISTS row_audit_star ON "{{.schema}}"."{{.table}}";
+		DROP TRIGGER IF EXISTS statement_audit_star ON "{{.schema}}"."{{.table}}";
+		DROP TRIGGER IF EXISTS updated_by_audit_star ON "{{.schema}}"."{{.table}}";
+		DROP FUNCTION IF EXISTS "{{.schema}}_audit_raw"."audit_{{.schema}}_{{.table}}"();
+		DROP FUNCTION IF EXISTS "{{.schema}}_audit_raw"."updated_by_{{.schema}}_{{.table}}"();
+		DROP VIEW IF EXISTS "{{.schema}}_audit"."{{.table}}_audit_delta";
+		DROP VIEW IF EXISTS "{{.schema}}_audit"."{{.table}}_audit_snapshot";
+		DROP VIEW IF EXISTS "{{.schema}}_audit"."{{.table}}_audit_compare";
+		DO
+		$$
+		BEGIN
+			IF to_regclass('audit.audit_history') IS NOT NULL THEN
+				UPDATE audit.audit_history SET end_time = now()
+				WHERE schema_name = '{{.schema}}'
+				AND table_name = '{{.table}}' AND end_time IS NULL;
+			END IF;
+			IF to_regclass('audit.stale_views') IS NOT NULL THEN
+				DELETE FROM audit.stale_views WHERE schema_name = '{{.schema}}' AND table_name = '{{.table}}';
+			END IF;
+		END
+		$$;`
 
-	_, err := db.Exec(mustParseQuery(query, data))
+	query, err := parseQuery(query, data)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("created audit schema %s.%s_audit\n", auditSchema, table)
+	err = db.inTx(func(tx *session) error {
+		_, err := tx.Exec(query)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	db.log.Info("removed auditing", Fields{"schema": schema, "table": table, "step": "remove", "duration": time.Since(start)})
 	return nil
 }
 
+// writes the rows of one raw audit table as JSON lines
+func exportAuditTable(schema, table string, db *session, w io.Writer) error {
+	auditTable := fmt.Sprintf(`"%s_audit_raw"."%s_audit"`, schema, table)
+
+	var exists bool
+	err := db.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, auditTable).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	query := fmt.Sprintf(`SELECT json_build_object('database', current_database(), 'schema', $1::TEXT, 'table', $2::TEXT, 'row', row_to_json(a))
+		FROM %s a
+		ORDER BY "%s_audit_id"`, auditTable, table)
+	rows, err := db.Query(query, schema, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var line []byte
+	for rows.Next() {
+		err = rows.Scan(&line)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "%s\n", line)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
 // created the index on an audit table
-func createAuditIndex(auditSchema, table string, db *sql.DB) error {
+func createAuditIndex(auditSchema, table string, db *session) error {
+	start := time.Now()
 	data := map[string]interface{}{
 		"auditSchema": auditSchema,
 		"table":       table,
@@ -841,17 +2030,24 @@ func createAuditIndex(auditSchema, table string, db *sql.DB) error {
 		$$
 		LANGUAGE plpgsql;`
 
-	_, err := db.Exec(mustParseQuery(query, data))
+	query, err := parseQuery(query, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(query)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("created audit index on %s.%s_audit\n", auditSchema, table)
+	db.log.Info("created audit index", Fields{"schema": strings.TrimSuffix(auditSchema, "_audit_raw"), "table": table, "step": "index", "duration": time.Since(start)})
 	return nil
 }
 
 // creates the audit function for a table
-func createAuditFunction(schema, table, jsonType, security string, logging bool, db *sql.DB) error {
+func createAuditFunction(schema, table string, c *Config, db *session) error {
+	start := time.Now()
+	opts := tableOptionsFor(schema, table, c)
 	query := `SELECT DISTINCT(objid::regclass) AS sequence_name
 		FROM pg_depend
 		JOIN pg_index ON indrelid = refobjid
@@ -863,13 +2059,60 @@ func createAuditFunction(schema, table, jsonType, security string, logging bool,
 
 	queryString := fmt.Sprintf(query, schema, table)
 	var sequenceName string
-	printQueryIfDebug(queryString)
 	err := db.QueryRow(queryString).Scan(&sequenceName)
 	if err != nil {
 		return err
 	}
 
-	query = `CREATE OR REPLACE FUNCTION "{{.schema}}_audit_raw"."audit_{{.schema}}_{{.table}}"()
+	if c.PayloadEngine == "jsonb" {
+		// keeps the json types of the row's values instead of flattening
+		// them to text like hstore does
+		query = `CREATE OR REPLACE FUNCTION "{{.schema}}_audit_raw"."audit_{{.schema}}_{{.table}}"()
+		RETURNS TRIGGER AS
+		$$
+		DECLARE
+			old_row JSONB = NULL;
+			new_row JSONB = NULL;
+			value_row JSONB = NULL;
+			change_row JSONB = NULL;
+			primary_key_value TEXT = NULL;
+			sparse_time TIMESTAMPTZ = NULL;
+			audit_id BIGINT;
+		BEGIN
+			{{.skipUpdates}}
+			SELECT nextval('{{.sequenceName}}') INTO audit_id;
+			IF (audit_id % 1000 = 0) THEN
+				sparse_time = now();
+			ELSE
+				sparse_time = NULL;
+			END IF;
+			IF (TG_OP = 'UPDATE') THEN
+				old_row = {{.oldRow}};
+				new_row = {{.newRow}};
+				SELECT COALESCE(jsonb_object_agg(o.key, CASE WHEN jsonb_typeof(o.value) = 'string' THEN to_jsonb(substring(o.value #>> '{}' FROM 1 FOR {{.valueMaxLength}})) ELSE o.value END), '{}'::JSONB) INTO value_row FROM jsonb_each(old_row) o WHERE o.value IS DISTINCT FROM new_row -> o.key;
+				SELECT COALESCE(jsonb_object_agg(n.key, n.value), '{}'::JSONB) INTO change_row FROM jsonb_each(new_row) n WHERE n.value IS DISTINCT FROM old_row -> n.key;
+				primary_key_value = new_row ->> TG_ARGV[0];
+			ELSIF (TG_OP = 'INSERT') THEN
+				new_row = {{.newRow}};
+				primary_key_value = new_row ->> TG_ARGV[0];
+			ELSIF (TG_OP = 'DELETE') THEN
+				old_row = {{.oldRow}};
+				SELECT jsonb_object_agg(o.key, CASE WHEN jsonb_typeof(o.value) = 'string' THEN to_jsonb(substring(o.value #>> '{}' FROM 1 FOR {{.valueMaxLength}})) ELSE o.value END) INTO value_row FROM jsonb_each(old_row) o;
+				primary_key_value = old_row ->> TG_ARGV[0];
+			ELSIF (TG_OP <> 'TRUNCATE') THEN
+				RETURN NULL;
+			END IF;
+
+			INSERT INTO "{{.schema}}_audit_raw"."{{.table}}_audit"("{{.table}}_audit_id", changed_at, changed_by, sparse_time, db_user, client_addr, client_port, client_query, operation, before_change, change, primary_key, after_change{{.extraColumns}})
+			VALUES(audit_id, now(), {{.changedBy}}, sparse_time, session_user::TEXT, inet_client_addr(), inet_client_port(), {{.clientQuery}}, substring(TG_OP,1,1), value_row, change_row, primary_key_value, {{.afterChange}}{{.extraValues}});
+
+			RETURN NULL;
+		END;
+		$$
+		LANGUAGE plpgsql
+		SECURITY {{.security}};`
+	} else {
+		query = `CREATE OR REPLACE FUNCTION "{{.schema}}_audit_raw"."audit_{{.schema}}_{{.table}}"()
 		RETURNS TRIGGER AS
 		$$
 		DECLARE
@@ -878,6 +2121,7 @@ func createAuditFunction(schema, table, jsonType, security string, logging bool,
 			sparse_time TIMESTAMPTZ = NULL;
 			audit_id BIGINT;
 		BEGIN
+			{{.skipUpdates}}
 			SELECT nextval('{{.sequenceName}}') INTO audit_id;
 			IF (audit_id % 1000 = 0) THEN
 				sparse_time = now();
@@ -885,36 +2129,36 @@ func createAuditFunction(schema, table, jsonType, security string, logging bool,
 				sparse_time = NULL;
 			END IF;
 			IF (TG_OP = 'UPDATE') THEN
-				new_row = hstore(NEW);
-				SELECT hstore(array_agg(sq.key), array_agg(sq.value)) INTO value_row FROM (SELECT (each(h.h)).key AS key, substring((each(h.h)).value FROM 1 FOR 500) AS value FROM (SELECT hstore(OLD) - hstore(NEW) AS h) h) sq;
+				new_row = {{.newRow}};
+				SELECT hstore(array_agg(sq.key), array_agg(sq.value)) INTO value_row FROM (SELECT (each(h.h)).key AS key, substring((each(h.h)).value FROM 1 FOR {{.valueMaxLength}}) AS value FROM (SELECT {{.oldRow}} - {{.newRow}} AS h) h) sq;
 				IF new_row ? TG_ARGV[0] THEN
-					INSERT INTO "{{.schema}}_audit_raw"."{{.table}}_audit"("{{.table}}_audit_id", changed_at, changed_by, sparse_time, db_user, client_addr, client_port, client_query, operation, before_change, change, primary_key)
-					VALUES(audit_id, now(), current_setting('audit_star.changed_by'), sparse_time, session_user::TEXT, inet_client_addr(), inet_client_port(), {{.clientQuery}}, substring(TG_OP,1,1), hstore_to_{{.jsonType}}(value_row), hstore_to_{{.jsonType}}(hstore(NEW) - hstore(OLD)), new_row -> TG_ARGV[0]);
+					INSERT INTO "{{.schema}}_audit_raw"."{{.table}}_audit"("{{.table}}_audit_id", changed_at, changed_by, sparse_time, db_user, client_addr, client_port, client_query, operation, before_change, change, primary_key, after_change{{.extraColumns}})
+					VALUES(audit_id, now(), {{.changedBy}}, sparse_time, session_user::TEXT, inet_client_addr(), inet_client_port(), {{.clientQuery}}, substring(TG_OP,1,1), hstore_to_{{.jsonType}}(value_row), hstore_to_{{.jsonType}}({{.newRow}} - {{.oldRow}}), new_row -> TG_ARGV[0], {{.afterChange}}{{.extraValues}});
 				ELSE
-					INSERT INTO "{{.schema}}_audit_raw"."{{.table}}_audit"("{{.table}}_audit_id", changed_at, changed_by, sparse_time, db_user, client_addr, client_port, client_query, operation, before_change, change, primary_key)
-					VALUES(audit_id, now(), current_setting('audit_star.changed_by'), sparse_time, session_user::TEXT, inet_client_addr(), inet_client_port(), {{.clientQuery}}, substring(TG_OP,1,1), hstore_to_{{.jsonType}}(value_row), hstore_to_{{.jsonType}}(hstore(NEW) - hstore(OLD)), NULL);
+					INSERT INTO "{{.schema}}_audit_raw"."{{.table}}_audit"("{{.table}}_audit_id", changed_at, changed_by, sparse_time, db_user, client_addr, client_port, client_query, operation, before_change, change, primary_key, after_change{{.extraColumns}})
+					VALUES(audit_id, now(), {{.changedBy}}, sparse_time, session_user::TEXT, inet_client_addr(), inet_client_port(), {{.clientQuery}}, substring(TG_OP,1,1), hstore_to_{{.jsonType}}(value_row), hstore_to_{{.jsonType}}({{.newRow}} - {{.oldRow}}), NULL, {{.afterChange}}{{.extraValues}});
 				END IF;
 			ELSIF (TG_OP = 'INSERT') THEN
-				value_row = hstore(NEW);
+				value_row = {{.newRow}};
 				IF value_row ? TG_ARGV[0] THEN
-					INSERT INTO "{{.schema}}_audit_raw"."{{.table}}_audit"("{{.table}}_audit_id", changed_at, changed_by, sparse_time, db_user, client_addr, client_port, client_query, operation, before_change, change, primary_key)
-					VALUES(audit_id, now(), current_setting('audit_star.changed_by'), sparse_time, session_user::TEXT, inet_client_addr(), inet_client_port(), {{.clientQuery}}, substring(TG_OP,1,1), NULL, NULL, value_row -> TG_ARGV[0]);
+					INSERT INTO "{{.schema}}_audit_raw"."{{.table}}_audit"("{{.table}}_audit_id", changed_at, changed_by, sparse_time, db_user, client_addr, client_port, client_query, operation, before_change, change, primary_key, after_change{{.extraColumns}})
+					VALUES(audit_id, now(), {{.changedBy}}, sparse_time, session_user::TEXT, inet_client_addr(), inet_client_port(), {{.clientQuery}}, substring(TG_OP,1,1), NULL, NULL, value_row -> TG_ARGV[0], {{.afterChange}}{{.extraValues}});
 				ELSE
-					INSERT INTO "{{.schema}}_audit_raw"."{{.table}}_audit"("{{.table}}_audit_id", changed_at, changed_by, sparse_time, db_user, client_addr, client_port, client_query, operation, before_change, change, primary_key)
-					VALUES(audit_id, now(), current_setting('audit_star.changed_by'), sparse_time, session_user::TEXT, inet_client_addr(), inet_client_port(), {{.clientQuery}}, substring(TG_OP,1,1), NULL, NULL, NULL);
+					INSERT INTO "{{.schema}}_audit_raw"."{{.table}}_audit"("{{.table}}_audit_id", changed_at, changed_by, sparse_time, db_user, client_addr, client_port, client_query, operation, before_change, change, primary_key, after_change{{.extraColumns}})
+					VALUES(audit_id, now(), {{.changedBy}}, sparse_time, session_user::TEXT, inet_client_addr(), inet_client_port(), {{.clientQuery}}, substring(TG_OP,1,1), NULL, NULL, NULL, {{.afterChange}}{{.extraValues}});
 				END IF;
 			ELSIF (TG_OP = 'DELETE') THEN
-				SELECT hstore(array_agg(sq.key), array_agg(sq.value)) INTO value_row FROM (SELECT (each(h)).key AS key, substring((each(h)).value FROM 1 FOR 500) AS value FROM hstore(OLD) h) sq;
+				SELECT hstore(array_agg(sq.key), array_agg(sq.value)) INTO value_row FROM (SELECT (each(h.h)).key AS key, substring((each(h.h)).value FROM 1 FOR {{.valueMaxLength}}) AS value FROM (SELECT {{.oldRow}} AS h) h) sq;
 				IF value_row ? TG_ARGV[0] THEN
-					INSERT INTO "{{.schema}}_audit_raw"."{{.table}}_audit"("{{.table}}_audit_id", changed_at, changed_by, sparse_time, db_user, client_addr, client_port, client_query, operation, before_change, change, primary_key)
-					VALUES(audit_id, now(), current_setting('audit_star.changed_by'), sparse_time, session_user::TEXT, inet_client_addr(), inet_client_port(), {{.clientQuery}}, substring(TG_OP,1,1), hstore_to_{{.jsonType}}(value_row), NULL, value_row -> TG_ARGV[0]);
+					INSERT INTO "{{.schema}}_audit_raw"."{{.table}}_audit"("{{.table}}_audit_id", changed_at, changed_by, sparse_time, db_user, client_addr, client_port, client_query, operation, before_change, change, primary_key, after_change{{.extraColumns}})
+					VALUES(audit_id, now(), {{.changedBy}}, sparse_time, session_user::TEXT, inet_client_addr(), inet_client_port(), {{.clientQuery}}, substring(TG_OP,1,1), hstore_to_{{.jsonType}}(value_row), NULL, value_row -> TG_ARGV[0], NULL{{.extraValues}});
 				ELSE
-					INSERT INTO "{{.schema}}_audit_raw"."{{.table}}_audit"("{{.table}}_audit_id", changed_at, changed_by, sparse_time, db_user, client_addr, client_port, client_query, operation, before_change, change, primary_key)
-					VALUES(audit_id, now(), current_setting('audit_star.changed_by'), sparse_time, session_user::TEXT, inet_client_addr(), inet_client_port(), {{.clientQuery}}, substring(TG_OP,1,1), hstore_to_{{.jsonType}}(value_row), NULL, NULL);
+					INSERT INTO "{{.schema}}_audit_raw"."{{.table}}_audit"("{{.table}}_audit_id", changed_at, changed_by, sparse_time, db_user, client_addr, client_port, client_query, operation, before_change, change, primary_key, after_change{{.extraColumns}})
+					VALUES(audit_id, now(), {{.changedBy}}, sparse_time, session_user::TEXT, inet_client_addr(), inet_client_port(), {{.clientQuery}}, substring(TG_OP,1,1), hstore_to_{{.jsonType}}(value_row), NULL, NULL, NULL{{.extraValues}});
 				END IF;
 			ELSIF (TG_OP = 'TRUNCATE') THEN
-				INSERT INTO "{{.schema}}_audit_raw"."{{.table}}_audit"("{{.table}}_audit_id", changed_at, changed_by, sparse_time, db_user, client_addr, client_port, client_query, operation, before_change, change, primary_key)
-				VALUES(audit_id, now(), current_setting('audit_star.changed_by'), sparse_time, session_user::TEXT, inet_client_addr(), inet_client_port(), {{.clientQuery}}, substring(TG_OP,1,1), NULL, NULL, NULL);
+				INSERT INTO "{{.schema}}_audit_raw"."{{.table}}_audit"("{{.table}}_audit_id", changed_at, changed_by, sparse_time, db_user, client_addr, client_port, client_query, operation, before_change, change, primary_key, after_change{{.extraColumns}})
+				VALUES(audit_id, now(), {{.changedBy}}, sparse_time, session_user::TEXT, inet_client_addr(), inet_client_port(), {{.clientQuery}}, substring(TG_OP,1,1), NULL, NULL, NULL, NULL{{.extraValues}});
 			ELSE
 				RETURN NULL;
 			END IF;
@@ -924,35 +2168,106 @@ func createAuditFunction(schema, table, jsonType, security string, logging bool,
 		$$
 		LANGUAGE plpgsql
 		SECURITY {{.security}};`
+	}
+
+	// excluded columns are stripped from the row before anything is recorded
+	oldRow, newRow := "hstore(OLD)", "hstore(NEW)"
+	if c.PayloadEngine == "jsonb" {
+		oldRow, newRow = "to_jsonb(OLD)", "to_jsonb(NEW)"
+	}
+	if len(opts.excludedColumns) > 0 {
+		if c.PayloadEngine == "jsonb" {
+			var stripped string
+			for _, column := range opts.excludedColumns {
+				stripped += " - '" + strings.Replace(column, "'", "''", -1) + "'"
+			}
+			oldRow, newRow = "(to_jsonb(OLD)"+stripped+")", "(to_jsonb(NEW)"+stripped+")"
+		} else {
+			excluded := sqlTextArray(opts.excludedColumns)
+			oldRow, newRow = "(hstore(OLD) - "+excluded+")", "(hstore(NEW) - "+excluded+")"
+		}
+	}
 
 	var clientQuery string
-	if logging {
-		clientQuery = "substring(current_query(), 1, 1000)"
+	if opts.logClientQuery {
+		clientQuery = fmt.Sprintf("substring(current_query(), 1, %d)", opts.queryMaxLength)
 	} else {
 		clientQuery = "NULL"
 	}
 
+	// the full after-image is only stored on inserts and updates
+	afterChange := "NULL"
+	if opts.storeFullRow {
+		if c.PayloadEngine == "jsonb" {
+			afterChange = "new_row"
+		} else {
+			afterChange = fmt.Sprintf("hstore_to_%s(%s)", c.JSONType, newRow)
+		}
+	}
+
+	// updates which change nothing, or only ignored columns, are dropped
+	// before an audit id is even taken
+	skipUpdates := ""
+	if opts.skipNoopUpdates || len(opts.ignoredColumns) > 0 {
+		changedKeys := fmt.Sprintf("skeys(%s - %s)", newRow, oldRow)
+		if c.PayloadEngine == "jsonb" {
+			changedKeys = fmt.Sprintf("(SELECT n.key FROM jsonb_each(%s) n WHERE n.value IS DISTINCT FROM %s -> n.key)", newRow, oldRow)
+		}
+
+		skipUpdates = fmt.Sprintf(`IF (TG_OP = 'UPDATE') THEN
+				IF NOT EXISTS (SELECT 1 FROM %s AS changed(key) WHERE changed.key <> ALL(%s)) THEN
+					RETURN NULL;
+				END IF;
+			END IF;`, changedKeys, sqlTextArray(opts.ignoredColumns))
+	}
+
+	// the tenant of each row is recorded for the row security policies, and
+	// the settings the actor was resolved from for the actor sources
+	extraColumns, extraValues := "", ""
+	if opts.rowSecurity {
+		extraColumns += ", tenant"
+		extraValues += ", " + tenantExpression(opts)
+	}
+	if len(c.ActorSources) > 0 {
+		extraColumns += ", actor_context"
+		extraValues += ", " + actorContextExpression(c)
+	}
+
 	data := map[string]interface{}{
-		"schema":       schema,
-		"table":        table,
-		"sequenceName": sequenceName,
-		"jsonType":     jsonType,
-		"clientQuery":  clientQuery,
-		"security":     security,
+		"schema":         schema,
+		"table":          table,
+		"sequenceName":   sequenceName,
+		"jsonType":       c.JSONType,
+		"clientQuery":    clientQuery,
+		"security":       opts.security,
+		"afterChange":    afterChange,
+		"skipUpdates":    skipUpdates,
+		"oldRow":         oldRow,
+		"newRow":         newRow,
+		"valueMaxLength": opts.valueMaxLength,
+		"changedBy":      changedByExpression(c),
+		"extraColumns":   extraColumns,
+		"extraValues":    extraValues,
+	}
+
+	query, err = parseQuery(query, data)
+	if err != nil {
+		return err
 	}
 
-	_, err = db.Exec(mustParseQuery(query, data))
+	_, err = db.Exec(query)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("created audit function for %s_audit_raw.audit_%s_%s\n", schema, schema, table)
+	db.log.Info("created audit function", Fields{"schema": schema, "table": table, "step": "function", "duration": time.Since(start)})
 	return nil
 }
 
 // creates the trigger which records the changes to the audit table
 // all tables have triggers created but those excluded by the config are disabled
-func createAuditTrigger(schema, table string, enabled bool, db *sql.DB) error {
+func createAuditTrigger(schema, table string, enabled bool, db *session) error {
+	start := time.Now()
 	query := `SELECT a.attname
 		FROM pg_index i
 		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
@@ -961,7 +2276,6 @@ func createAuditTrigger(schema, table string, enabled bool, db *sql.DB) error {
 		WHERE i.indisprimary
 		AND nspname = '%s'
 		AND relname = '%s'`
-	printQueryIfDebug(fmt.Sprintf(query, schema, table))
 	rows, err := db.Query(fmt.Sprintf(query, schema, table))
 	if err != nil {
 		return err
@@ -983,8 +2297,7 @@ func createAuditTrigger(schema, table string, enabled bool, db *sql.DB) error {
 		"table":  table,
 	}
 
-	query = `BEGIN;
-		DROP TRIGGER IF EXISTS row_audit_star ON "{{.schema}}"."{{.table}}";
+	query = `DROP TRIGGER IF EXISTS row_audit_star ON "{{.schema}}"."{{.table}}";
 		DROP TRIGGER IF EXISTS statement_audit_star ON "{{.schema}}"."{{.table}}";`
 
 	if len(primaryKeys) == 1 {
@@ -1024,34 +2337,45 @@ func createAuditTrigger(schema, table string, enabled bool, db *sql.DB) error {
 		query += `ALTER TABLE "{{.schema}}"."{{.table}}" DISABLE TRIGGER row_audit_star;
 			ALTER TABLE "{{.schema}}"."{{.table}}" DISABLE TRIGGER statement_audit_star;`
 
-		// must break since ddl replication w/ pg_logical using our in-house
-		// extension cannot handle mixed DDL/DML in the same client statement
-
-		_, err = db.Exec(mustParseQuery(query, data))
-		if err != nil {
-			return err
-		}
+	}
 
-		query = `UPDATE audit.audit_history SET end_time = now()
+	// must break since ddl replication w/ pg_logical using our in-house
+	// extension cannot handle mixed DDL/DML in the same client statement
+	queries := []string{query}
+	if !enabled {
+		queries = append(queries, `UPDATE audit.audit_history SET end_time = now()
 			WHERE schema_name = '{{.schema}}'
-			AND table_name = '{{.table}}' AND end_time IS NULL;`
+			AND table_name = '{{.table}}' AND end_time IS NULL;`)
 	}
-	query += "COMMIT;"
 
-	_, err = db.Exec(mustParseQuery(query, data))
+	err = db.inTx(func(tx *session) error {
+		for _, query := range queries {
+			query, err := parseQuery(query, data)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(query)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	log.Printf("audit trigger created for %s.%s enabled:%v\n", schema, table, enabled)
+	db.log.Info("audit trigger created", Fields{"schema": schema, "table": table, "step": "trigger", "enabled": enabled, "duration": time.Since(start)})
 	return nil
 }
 
 // creates a view to aid in querying the db for what has changed
-func createAuditDeltaView(schema, table, grantee string, tableCols []map[string]string, primaryKeyCol map[string]string, db *sql.DB) error {
+func createAuditDeltaView(schema, table, jsonType string, fullRow bool, tableCols []map[string]string, primaryKeyCol map[string]string, rowFilter string, db *session) error {
+	start := time.Now()
 	query := `
 		DROP VIEW IF EXISTS "{{.schema}}_audit"."{{.table}}_audit_delta";
-		CREATE VIEW "{{.schema}}_audit"."{{.table}}_audit_delta" AS
+		CREATE VIEW "{{.schema}}_audit"."{{.table}}_audit_delta"{{.barrier}} AS
 		SELECT "{{.table}}_audit_id",
 						"{{.table}}_audit".primary_key AS primary_key,
 						"{{.table}}_audit".changed_at AS audited_changed_at,
@@ -1062,16 +2386,25 @@ func createAuditDeltaView(schema, table, grantee string, tableCols []map[string]
 	data := map[string]interface{}{
 		"schema":  schema,
 		"table":   table,
-		"grantee": grantee,
+		"barrier": securityBarrier(rowFilter),
 	}
 
-	query = mustParseQuery(query, data)
+	var b queryBuilder
+	b.add(query, data)
 
 	for _, col := range tableCols {
-		q := `(before_change ->> '{{.colName}}')::{{.dataType}} AS "old_{{.colName}}",
-			CASE WHEN "{{.table}}_audit".operation = 'I' THEN COALESCE(
+		q := `{{.beforeValue}} AS "old_{{.colName}}",
+			CASE `
+
+		// inserts which stored their full row don't need to be reconstructed
+		if fullRow {
+			q += `WHEN "{{.table}}_audit".operation = 'I' AND "{{.table}}_audit".after_change IS NOT NULL THEN {{.afterValue}}
+			`
+		}
+
+		q += `WHEN "{{.table}}_audit".operation = 'I' THEN COALESCE(
 				(
-					SELECT DISTINCT ON (primary_key) (before_change ->> '{{.colName}}')::{{.dataType}}
+					SELECT DISTINCT ON (primary_key) {{.beforeValue}}
 					FROM "{{.schema}}_audit_raw"."{{.table}}_audit" spa
 					WHERE spa.primary_key = "{{.table}}_audit".primary_key
 					AND spa."{{.table}}_audit_id" > "{{.table}}_audit"."{{.table}}_audit_id"
@@ -1080,27 +2413,31 @@ func createAuditDeltaView(schema, table, grantee string, tableCols []map[string]
 				),`
 
 		if primaryKeyCol != nil {
-			q += `("{{.table}}_json" ->> '{{.colName}}')::{{.dataType}}`
+			q += `{{.liveValue}}`
 		} else {
 			q += "NULL"
 		}
 
 		q += `)
-			ELSE (change ->> '{{.colName}}')::{{.dataType}}
+			ELSE {{.changeValue}}
 			END AS "new_{{.colName}}",`
 
 		data = map[string]interface{}{
-			"colName":    col["colName"],
-			"dataType":   col["dataType"],
-			"primaryKey": col["primaryKey"],
-			"schema":     schema,
-			"table":      table,
+			"colName":     col["colName"],
+			"dataType":    col["dataType"],
+			"primaryKey":  col["primaryKey"],
+			"schema":      schema,
+			"table":       table,
+			"beforeValue": jsonColumnValue("before_change", col["colName"], col["dataType"], jsonType),
+			"changeValue": jsonColumnValue("change", col["colName"], col["dataType"], jsonType),
+			"liveValue":   jsonColumnValue(`"`+table+`_json"`, col["colName"], col["dataType"], jsonType),
+			"afterValue":  jsonColumnValue(`"`+table+`_audit".after_change`, col["colName"], col["dataType"], jsonType),
 		}
 
-		query += mustParseQuery(q, data)
+		b.add(q, data)
 	}
 
-	query = strings.TrimSuffix(query, ",")
+	b.query = strings.TrimSuffix(b.query, ",")
 
 	q := ` FROM "{{.schema}}_audit_raw"."{{.table}}_audit" `
 
@@ -1112,39 +2449,29 @@ func createAuditDeltaView(schema, table, grantee string, tableCols []map[string]
 		data["pkcColName"] = primaryKeyCol["colName"]
 	}
 
-	if grantee != "" {
-		q += "; GRANT SELECT ON \"{{.schema}}_audit\".\"{{.table}}_audit_delta\" TO " + grantee + "; "
-	} else {
-		q += "; "
-	}
+	q += rowFilter + "; "
 
-	query += mustParseQuery(q, data)
+	b.add(q, data)
 
-	tx, txErr := db.Begin()
-	if txErr != nil {
-		return txErr
+	if b.err != nil {
+		return b.err
 	}
 
-	_, err := tx.Exec(query)
+	err := db.inTx(func(tx *session) error {
+		_, err := tx.Exec(b.query)
+		return err
+	})
 	if err != nil {
-		tx.Rollback()
-		log.Println("error occurred while creating delta view: ", err)
-		errorCounter++
-		return nil
+		return fmt.Errorf("error occurred while creating delta view: %w", err)
 	}
 
-	if err = tx.Commit(); err != nil {
-		log.Println("error committing delta view transaction: ", err)
-		return nil
-	}
-
-	log.Printf("created view %s_audit.%s_audit_delta\n", schema, table)
+	db.log.Info("created delta view", Fields{"schema": schema, "table": table, "step": "delta_view", "duration": time.Since(start)})
 	return nil
 }
 
 // creates the schema which holds the views which aid in querying
 // the audit tables for what has changed
-func createViewAuditSchema(schema string, db *sql.DB) error {
+func createViewAuditSchema(schema string, db *session) error {
 	query := `DO
 		$$
 		BEGIN
@@ -1161,7 +2488,12 @@ func createViewAuditSchema(schema string, db *sql.DB) error {
 
 	data := map[string]interface{}{"schema": schema}
 
-	_, err := db.Exec(mustParseQuery(query, data))
+	query, err := parseQuery(query, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(query)
 	if err != nil {
 		return err
 	}
@@ -1170,7 +2502,7 @@ func createViewAuditSchema(schema string, db *sql.DB) error {
 }
 
 // returns true if table has only 1 primary key, false if 0 or >1
-func hasValidPrimaryKey(schema, table string, db *sql.DB) (bool, error) {
+func hasValidPrimaryKey(schema, table string, db *session) (bool, error) {
 	query := `select coalesce((select format($$'%s'$$, a.attname)
 		from pg_attribute a
 		join pg_index i on a.attrelid = i.indexrelid
@@ -1183,7 +2515,12 @@ func hasValidPrimaryKey(schema, table string, db *sql.DB) (bool, error) {
 		"table":  table,
 	}
 
-	rows, err := db.Query(mustParseQuery(query, data))
+	query, err := parseQuery(query, data)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := db.Query(query)
 	if err != nil {
 		return false, err
 	}
@@ -1196,16 +2533,35 @@ func hasValidPrimaryKey(schema, table string, db *sql.DB) (bool, error) {
 		}
 
 		if primaryKey == "" {
-			log.Printf("SKIPPED table %s.%s due to zero or multi-field PK\n", schema, table)
 			return false, nil
 		}
 	}
 	return true, nil
 }
 
+// returns true if the given column exists on schema.table
+func hasColumn(schema, table, column string, db *session) (bool, error) {
+	query := `SELECT EXISTS (
+		SELECT 1
+		FROM pg_attribute
+		WHERE attrelid = to_regclass(format('%I.%I', $1::TEXT, $2::TEXT))
+		AND attname = $3
+		AND attnum > 0
+		AND NOT attisdropped
+	) AS exists`
+
+	var exists bool
+	err := db.QueryRow(query, schema, table, column).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
 // returns a map containing the column name, data type and primary key for
 // each column of a given table
-func tableColumns(schema, table string, db *sql.DB) ([]map[string]string, error) {
+func tableColumns(schema, table string, db *session) ([]map[string]string, error) {
 	query := `SELECT DISTINCT ON(attname)
 						attname AS column_name,
 						format_type(atttypid, atttypmod) AS data_type,
@@ -1222,7 +2578,12 @@ func tableColumns(schema, table string, db *sql.DB) ([]map[string]string, error)
 		"table":  table,
 	}
 
-	rows, err := db.Query(mustParseQuery(query, data))
+	query, err := parseQuery(query, data)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -1259,10 +2620,11 @@ func getPrimaryKeyCol(tableCols []map[string]string) map[string]string {
 }
 
 // creates an audit snapshot view to aid in querying for changes
-func createAuditSnapshotView(schema, table, grantee string, tableCols []map[string]string, primaryKeyCol map[string]string, db *sql.DB) error {
+func createAuditSnapshotView(schema, table, jsonType string, fullRow bool, tableCols []map[string]string, primaryKeyCol map[string]string, rowFilter string, db *session) error {
+	start := time.Now()
 	q := `
 		DROP VIEW IF EXISTS "{{.schema}}_audit"."{{.table}}_audit_snapshot";
-		CREATE VIEW "{{.schema}}_audit"."{{.table}}_audit_snapshot" AS
+		CREATE VIEW "{{.schema}}_audit"."{{.table}}_audit_snapshot"{{.barrier}} AS
 		SELECT "{{.table}}_audit_id",
 						"{{.table}}_audit".primary_key AS primary_key,
 						"{{.table}}_audit".changed_at AS audited_changed_at,
@@ -1273,33 +2635,44 @@ func createAuditSnapshotView(schema, table, grantee string, tableCols []map[stri
 	data := map[string]interface{}{
 		"schema":  schema,
 		"table":   table,
-		"grantee": grantee,
+		"barrier": securityBarrier(rowFilter),
 	}
 
-	query := mustParseQuery(q, data)
+	var b queryBuilder
+	b.add(q, data)
 
 	for _, col := range tableCols {
-		q = `COALESCE((change ->> '{{.colName}}')::{{.dataType}}, COALESCE("{{.colName}}_join".value,`
+		q = `COALESCE({{.changeValue}}, COALESCE("{{.colName}}_join".value,`
 
 		if primaryKeyCol != nil {
-			q += `("{{.table}}_json" ->> '{{.colName}}')::{{.dataType}}`
+			q += `{{.liveValue}}`
 		} else {
 			q += "NULL"
 		}
 
-		q += `)) AS "{{.colName}}",`
+		q += `))`
+
+		// rows which stored their full row are read directly
+		if fullRow {
+			q = `CASE WHEN "{{.table}}_audit".after_change IS NOT NULL THEN {{.afterValue}} ELSE ` + q + ` END`
+		}
+
+		q += ` AS "{{.colName}}",`
 
 		data = map[string]interface{}{
-			"schema":   schema,
-			"table":    table,
-			"colName":  col["colName"],
-			"dataType": col["dataType"],
+			"schema":      schema,
+			"table":       table,
+			"colName":     col["colName"],
+			"dataType":    col["dataType"],
+			"changeValue": jsonColumnValue("change", col["colName"], col["dataType"], jsonType),
+			"liveValue":   jsonColumnValue(`"`+table+`_json"`, col["colName"], col["dataType"], jsonType),
+			"afterValue":  jsonColumnValue(`"`+table+`_audit".after_change`, col["colName"], col["dataType"], jsonType),
 		}
 
-		query += mustParseQuery(q, data)
+		b.add(q, data)
 	}
 
-	query = strings.TrimSuffix(query, ",")
+	b.query = strings.TrimSuffix(b.query, ",")
 
 	q = ` FROM "{{.schema}}_audit_raw"."{{.table}}_audit"`
 
@@ -1311,59 +2684,59 @@ func createAuditSnapshotView(schema, table, grantee string, tableCols []map[stri
 		data["pkcColName"] = primaryKeyCol["colName"]
 	}
 
-	query += mustParseQuery(q, data)
+	b.add(q, data)
 
 	for _, col := range tableCols {
 		q = `LEFT JOIN LATERAL (
 			SELECT DISTINCT ON(primary_key)
-			(before_change ->> '{{.colName}}')::{{.dataType}} AS value
+			{{.beforeValue}} AS value
 			FROM "{{.schema}}_audit_raw"."{{.table}}_audit" spa
 			WHERE (before_change -> '{{.colName}}') IS NOT NULL
 			AND spa."{{.table}}_audit_id" > "{{.table}}_audit"."{{.table}}_audit_id"
-			AND spa.primary_key = "{{.table}}_audit".primary_key
+			AND spa.primary_key = "{{.table}}_audit".primary_key`
+
+		// skips the lookup entirely for rows which stored their full row
+		if fullRow {
+			q += `
+			AND "{{.table}}_audit".after_change IS NULL`
+		}
+
+		q += `
 			ORDER BY spa.primary_key, spa."{{.table}}_audit_id"
 			) "{{.colName}}_join" ON TRUE `
 
 		data["colName"] = col["colName"]
 		data["dataType"] = col["dataType"]
+		data["beforeValue"] = jsonColumnValue("before_change", col["colName"], col["dataType"], jsonType)
 
-		query += mustParseQuery(q, data)
+		b.add(q, data)
 	}
 
-	if grantee != "" {
-		query += mustParseQuery("; GRANT SELECT ON \"{{.schema}}_audit\".\"{{.table}}_audit_snapshot\" TO "+grantee+"; ", data)
-	} else {
-		query += "; "
-	}
+	b.query += rowFilter + "; "
 
-	tx, txErr := db.Begin()
-	if txErr != nil {
-		return txErr
+	if b.err != nil {
+		return b.err
 	}
 
-	_, err := tx.Exec(query)
+	err := db.inTx(func(tx *session) error {
+		_, err := tx.Exec(b.query)
+		return err
+	})
 	if err != nil {
-		tx.Rollback()
-		log.Println("error occurred while creating snapshot view: ", err)
-		errorCounter++
-		return nil
-	}
-
-	if err = tx.Commit(); err != nil {
-		log.Println("error committing delta view transaction: ", err)
-		return nil
+		return fmt.Errorf("error occurred while creating snapshot view: %w", err)
 	}
 
-	log.Printf("created view %s_audit.%s_audit_snapshot\n", schema, table)
+	db.log.Info("created snapshot view", Fields{"schema": schema, "table": table, "step": "snapshot_view", "duration": time.Since(start)})
 	return nil
 }
 
 // creates a compare view to aid in querying for changes
-func createAuditCompareView(schema, table, grantee string, tableCols []map[string]string, primaryKeyCol map[string]string, db *sql.DB) error {
+func createAuditCompareView(schema, table, jsonType string, fullRow bool, tableCols []map[string]string, primaryKeyCol map[string]string, rowFilter string, db *session) error {
+	start := time.Now()
 	q := `
 		DROP VIEW IF EXISTS "{{.schema}}_audit"."{{.table}}_audit";
 		DROP VIEW IF EXISTS "{{.schema}}_audit"."{{.table}}_audit_compare";
-		CREATE VIEW "{{.schema}}_audit"."{{.table}}_audit_compare" AS
+		CREATE VIEW "{{.schema}}_audit"."{{.table}}_audit_compare"{{.barrier}} AS
 		SELECT "{{.table}}_audit_id",
 						"{{.table}}_audit".primary_key AS primary_key,
 						"{{.table}}_audit".changed_at AS audited_changed_at,
@@ -1374,43 +2747,65 @@ func createAuditCompareView(schema, table, grantee string, tableCols []map[strin
 	data := map[string]interface{}{
 		"schema":  schema,
 		"table":   table,
-		"grantee": grantee,
+		"barrier": securityBarrier(rowFilter),
 	}
 
-	query := mustParseQuery(q, data)
+	var b queryBuilder
+	b.add(q, data)
 
 	for _, col := range tableCols {
-		q = ` COALESCE((before_change ->> '{{.colName}}')::{{.dataType}},
+		q = ` COALESCE({{.beforeValue}},
 			CASE WHEN "{{.table}}_audit".operation = 'I' THEN NULL ELSE
 			COALESCE("{{.colName}}_join".value,`
 
 		if primaryKeyCol != nil {
-			q += ` ("{{.table}}_json" ->> '{{.colName}}')::{{.dataType}}`
+			q += ` {{.liveValue}}`
 		} else {
 			q += " NULL"
 		}
 
 		q += `)
-			END) AS "old_{{.colName}}",
-			COALESCE((change ->> '{{.colName}}')::{{.dataType}}, COALESCE(
+			END)`
+
+		// rows which stored their full row are read directly, columns missing
+		// from before_change did not change and so equal their new value
+		if fullRow {
+			q = ` CASE WHEN "{{.table}}_audit".after_change IS NULL THEN` + q + `
+			WHEN "{{.table}}_audit".operation = 'I' THEN NULL
+			WHEN ("{{.table}}_audit".before_change -> '{{.colName}}') IS NOT NULL THEN {{.beforeValue}}
+			ELSE {{.afterValue}}
+			END`
+		}
+
+		newQ := ` COALESCE({{.changeValue}}, COALESCE(
 			CASE WHEN "{{.table}}_audit".operation = 'D'
 			OR "{{.table}}_audit".operation = 'T' THEN NULL ELSE "{{.colName}}_join".value END,`
 
 		if primaryKeyCol != nil {
-			q += `("{{.table}}_json" ->> '{{.colName}}')::{{.dataType}}`
+			newQ += `{{.liveValue}}`
 		} else {
-			q += "NULL"
+			newQ += "NULL"
 		}
 
-		q += `)) AS "new_{{.colName}}",`
+		newQ += `))`
+
+		if fullRow {
+			newQ = ` CASE WHEN "{{.table}}_audit".after_change IS NOT NULL THEN {{.afterValue}} ELSE` + newQ + ` END`
+		}
+
+		q += ` AS "old_{{.colName}}",` + newQ + ` AS "new_{{.colName}}",`
 
 		data["colName"] = col["colName"]
 		data["dataType"] = col["dataType"]
+		data["beforeValue"] = jsonColumnValue("before_change", col["colName"], col["dataType"], jsonType)
+		data["changeValue"] = jsonColumnValue("change", col["colName"], col["dataType"], jsonType)
+		data["liveValue"] = jsonColumnValue(`"`+table+`_json"`, col["colName"], col["dataType"], jsonType)
+		data["afterValue"] = jsonColumnValue(`"`+table+`_audit".after_change`, col["colName"], col["dataType"], jsonType)
 
-		query += mustParseQuery(q, data)
+		b.add(q, data)
 	}
 
-	query = strings.TrimSuffix(query, ",")
+	b.query = strings.TrimSuffix(b.query, ",")
 
 	q = `FROM "{{.schema}}_audit_raw"."{{.table}}_audit"`
 
@@ -1422,58 +2817,51 @@ func createAuditCompareView(schema, table, grantee string, tableCols []map[strin
 	data["pkcDataType"] = primaryKeyCol["dataType"]
 	data["pkcColName"] = primaryKeyCol["colName"]
 
-	query += mustParseQuery(q, data)
+	b.add(q, data)
 
 	for _, col := range tableCols {
 		q = ` LEFT JOIN LATERAL (
 			SELECT DISTINCT ON(primary_key)
-			(before_change ->> '{{.colName}}')::{{.dataType}} AS value
+			{{.beforeValue}} AS value
 			FROM "{{.schema}}_audit_raw"."{{.table}}_audit" spa
 			WHERE (before_change -> '{{.colName}}') IS NOT NULL
 			AND spa."{{.table}}_audit_id" > "{{.table}}_audit"."{{.table}}_audit_id"
-			AND spa.primary_key = "{{.table}}_audit".primary_key
+			AND spa.primary_key = "{{.table}}_audit".primary_key`
+
+		// skips the lookup entirely for rows which stored their full row
+		if fullRow {
+			q += `
+			AND "{{.table}}_audit".after_change IS NULL`
+		}
+
+		q += `
 			ORDER BY spa.primary_key, spa."{{.table}}_audit_id"
 			) "{{.colName}}_join" ON TRUE `
 
 		data = map[string]interface{}{
-			"schema":   schema,
-			"table":    table,
-			"colName":  col["colName"],
-			"dataType": col["dataType"],
+			"schema":      schema,
+			"table":       table,
+			"colName":     col["colName"],
+			"dataType":    col["dataType"],
+			"beforeValue": jsonColumnValue("before_change", col["colName"], col["dataType"], jsonType),
 		}
 
-		query += mustParseQuery(q, data)
+		b.add(q, data)
 	}
 
-	if grantee != "" {
-		query += mustParseQuery("; GRANT SELECT ON \"{{.schema}}_audit\".\"{{.table}}_audit_compare\" TO "+grantee+"; ", data)
-	} else {
-		query += "; "
-	}
-	tx, txErr := db.Begin()
-	if txErr != nil {
-		return txErr
+	b.query += rowFilter + "; "
+	if b.err != nil {
+		return b.err
 	}
 
-	_, err := tx.Exec(query)
+	err := db.inTx(func(tx *session) error {
+		_, err := tx.Exec(b.query)
+		return err
+	})
 	if err != nil {
-		tx.Rollback()
-		log.Println("error occurred while creating compare view: ", err)
-		errorCounter++
-		return nil
-	}
-
-	if err = tx.Commit(); err != nil {
-		log.Println("error committing delta view transaction: ", err)
-		return nil
+		return fmt.Errorf("error occurred while creating compare view: %w", err)
 	}
 
-	log.Printf("created view %s_audit.%s_audit_compare\n", schema, table)
+	db.log.Info("created compare view", Fields{"schema": schema, "table": table, "step": "compare_view", "duration": time.Since(start)})
 	return nil
 }
-
-func printQueryIfDebug(query string) {
-	if os.Getenv("QUERY_DEBUG") == "1" {
-		fmt.Println(query)
-	}
-}
@@ -1,20 +1,30 @@
 package audit
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
 	"database/sql"
-	"flag"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v3"
 )
 
 var db *sql.DB
 
 func TestMain(m *testing.M) {
 	var config Config
-	ParseFlags(&config)
+	config.CfgPath = DefaultConfigPath
 	getConfig(&config)
 
 	// Open DB
@@ -59,9 +69,150 @@ func TestGetConfig(t *testing.T) {
 	assert.Error(t, getconfigErr)
 }
 
+func TestValidateConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "audit_*.yml")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(`db_name: audit_star
+exluded_tables:
+  - teststar.table_skipme
+security: defnier
+lock_timeout: 5 seconds
+included_tables:
+  - teststar.table1
+  - table2
+tables:
+  teststar.table1:
+    trigger: off
+grants:
+  - role: analysts
+    scopes: [views, reports]
+`)
+	assert.NoError(t, err)
+	file.Close()
+
+	// unknown keys are reported with their lines, the rest is still decoded
+	c := Config{CfgPath: file.Name()}
+	err = GetConfig(&c)
+	assert.EqualError(t, err, "invalid config:\n  line 2: field exluded_tables not found in type audit.Config")
+	assert.Equal(t, "audit_star", c.DBName)
+
+	err = Validate(&c)
+	assert.Equal(t, ConfigErrors{
+		{Line: 4, Field: "security", Message: `unknown value "defnier", expected one of definer, invoker`},
+		{Line: 5, Field: "lock_timeout", Message: `"5 seconds" is not a duration like 500ms, 5s or 1min`},
+		{Line: 8, Field: "included_tables[1]", Message: `"table2": table should be specified in the following format: schemaname.tablename`},
+		{Line: 11, Field: "tables[teststar.table1].trigger", Message: `unknown value "off", expected one of enabled, disabled`},
+		{Line: 14, Field: "grants[0].scopes", Message: `unknown value "reports", expected one of raw_tables, views, functions`},
+	}, err)
+
+	// settings from flags have no line
+	c = Config{SSLMode: "verify"}
+	err = Validate(&c)
+	assert.EqualError(t, err, "invalid config:\n  ssl_mode: unknown value \"verify\", expected one of disable, allow, prefer, require, verify-ca, verify-full")
+}
+
+func TestConfigFromEnvironment(t *testing.T) {
+	os.Setenv("AUDIT_STAR_TEST_PASSWORD", "it's a secret")
+	defer os.Unsetenv("AUDIT_STAR_TEST_PASSWORD")
+	os.Setenv("DATABASE_URL", "postgres://someone@somehost:5433/somedb?sslmode=require")
+	defer os.Unsetenv("DATABASE_URL")
+
+	os.Setenv("AUDIT_STAR_TEST_HOST", "p#ss: *x")
+	defer os.Unsetenv("AUDIT_STAR_TEST_HOST")
+	os.Setenv("AUDIT_STAR_TEST_PARALLELISM", "4")
+	defer os.Unsetenv("AUDIT_STAR_TEST_PARALLELISM")
+
+	// ${NAME} is replaced in the values once the file is parsed
+	var c Config
+	err := yaml.Unmarshal([]byte("password: ${AUDIT_STAR_TEST_PASSWORD}\nusername: ${AUDIT_STAR_TEST_UNSET}\nhost: db-${AUDIT_STAR_TEST_HOST}\nparallelism: ${AUDIT_STAR_TEST_PARALLELISM}"), &expandedConfig{&c})
+	assert.NoError(t, err)
+	assert.Equal(t, "it's a secret", c.DBPassword)
+	assert.Equal(t, "", c.DBUser)
+	assert.Equal(t, "db-p#ss: *x", c.Host)
+	assert.Equal(t, 4, c.Parallelism)
+	c.Host = ""
+
+	// settings from the config file are appended to DATABASE_URL
+	c.DBName = "otherdb"
+	dbInfo, err := connString(&c)
+	assert.NoError(t, err)
+	assert.Equal(t, `dbname='somedb' host='somehost' port='5433' sslmode='require' user='someone' dbname='otherdb' password='it\'s a secret'`, dbInfo)
+
+	// set_role and lock_timeout start every connection of the pool
+	c.OwnerRole, c.LockTimeout = "audit owner", "5s"
+	dbInfo, err = connString(&c)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasSuffix(dbInfo, ` options='-c role=audit\\ owner -c lock_timeout=5s'`), dbInfo)
+
+	// dsn takes precedence over DATABASE_URL
+	c = Config{DSN: "host=localhost dbname=audit_star"}
+	dbInfo, err = connString(&c)
+	assert.NoError(t, err)
+	assert.Equal(t, "host=localhost dbname=audit_star", dbInfo)
+}
+
+func TestDatabaseConfigs(t *testing.T) {
+	file, err := ioutil.TempFile("", "audit_*.yml")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(`username: audit_owner
+security: definer
+tables:
+  teststar.table1:
+    retention: 90 days
+databases:
+  - orders
+  - db_name: billing
+    host: billing.internal
+    security: invoker
+    tables:
+      teststar.table2:
+        retention: 7 years
+  - db_name: shard_*
+    retention: forever
+    hots: shards.internal
+`)
+	assert.NoError(t, err)
+	file.Close()
+
+	c := Config{CfgPath: file.Name()}
+	err = GetConfig(&c)
+	assert.NoError(t, err)
+
+	// entries override the top-level settings, unknown keys are reported
+	// with their lines
+	configs, err := DatabaseConfigs(&c)
+	assert.EqualError(t, err, "invalid config:\n  line 16: databases[2]: field hots not found in type audit.Config")
+	assert.Len(t, configs, 3)
+
+	assert.Equal(t, "orders", configs[0].DBName)
+	assert.Equal(t, "audit_owner", configs[0].DBUser)
+	assert.Equal(t, "definer", configs[0].Security)
+	assert.Len(t, configs[0].Tables, 1)
+
+	assert.Equal(t, "billing", configs[1].DBName)
+	assert.Equal(t, "billing.internal", configs[1].Host)
+	assert.Equal(t, "invoker", configs[1].Security)
+	assert.Equal(t, "audit_owner", configs[1].DBUser)
+	assert.Equal(t, "90 days", configs[1].Tables["teststar.table1"].Retention)
+	assert.Equal(t, "7 years", configs[1].Tables["teststar.table2"].Retention)
+	assert.Len(t, c.Tables, 1)
+
+	// problems of an entry point at its own lines
+	err = Validate(&configs[2])
+	assert.EqualError(t, err, "invalid config:\n  line 15: retention: \"forever\" is not an interval like 90 days")
+
+	// databases named outright are not looked up in the cluster
+	expanded, err := ExpandDatabases(configs[:2])
+	assert.NoError(t, err)
+	assert.Len(t, expanded, 2)
+}
+
 func TestTableExclusions(t *testing.T) {
 	var c Config
-	ParseFlags(&c)
 	c.CfgPath = "./audit.yml"
 	getConfigErr := GetConfig(&c)
 	assert.NoError(t, getConfigErr)
@@ -87,7 +238,6 @@ func TestTableExclusions(t *testing.T) {
 
 func TestSchemaExclusions(t *testing.T) {
 	var c Config
-	ParseFlags(&c)
 	c.CfgPath = "./audit.yml"
 	getConfigErr := GetConfig(&c)
 	assert.NoError(t, getConfigErr)
@@ -606,6 +756,955 @@ func TestDropColumns(t *testing.T) {
 
 }
 
+func TestRefreshStaleViews(t *testing.T) {
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	// arrangement
+	_, alterErr := db.Exec("alter table teststar.table_refresh add column column3 text;")
+	assert.NoError(t, alterErr)
+	defer db.Exec("alter table teststar.table_refresh drop column column3;")
+
+	row := db.QueryRow(`SELECT EXISTS (
+			SELECT 1
+			FROM audit.stale_views
+			WHERE schema_name = 'teststar'
+			AND table_name = 'table_refresh'
+			) AS exists`)
+
+	c := column{}
+	scanErr := row.Scan(&c.exists)
+	assert.NoError(t, scanErr)
+	assert.Equal(t, "true", c.exists.String)
+
+	// act
+	refreshErr := RefreshViews(db, &config)
+	assert.NoError(t, refreshErr)
+
+	// assertion
+	row = db.QueryRow(`SELECT EXISTS (
+			SELECT 1
+			FROM information_schema.columns
+			WHERE table_schema = 'teststar_audit'
+			AND table_name = 'table_refresh_audit_compare'
+			AND column_name = 'new_column3'
+			) AS exists`)
+
+	c = column{}
+	scanErr = row.Scan(&c.exists)
+	assert.NoError(t, scanErr)
+	assert.Equal(t, "true", c.exists.String)
+
+	row = db.QueryRow(`SELECT EXISTS (
+			SELECT 1
+			FROM audit.stale_views
+			WHERE schema_name = 'teststar'
+			AND table_name = 'table_refresh'
+			) AS exists`)
+
+	c = column{}
+	scanErr = row.Scan(&c.exists)
+	assert.NoError(t, scanErr)
+	assert.Equal(t, "false", c.exists.String)
+}
+
+func TestDDLHistory(t *testing.T) {
+	// arrangement
+	tx, txErr := db.Begin()
+	assert.NoError(t, txErr)
+	defer tx.Rollback()
+
+	// act
+	_, alterErr := tx.Exec("SET LOCAL audit_star.changed_by TO sr; alter table teststar.table1 drop column column3;")
+	assert.NoError(t, alterErr)
+
+	row := tx.QueryRow(`SELECT changed_by
+			FROM audit.ddl_history
+			WHERE command_tag = 'ALTER TABLE'
+			AND object_identity = 'teststar.table1'
+			AND command LIKE '%drop column column3%'
+			ORDER BY ddl_history_id DESC
+			LIMIT 1`)
+
+	// assertion
+	c := column{}
+	scanErr := row.Scan(&c.changedBy)
+	assert.NoError(t, scanErr)
+	assert.Equal(t, "sr", c.changedBy.String)
+
+	// audit_star's own schemas are not recorded
+	_, alterErr = tx.Exec("alter table teststar_audit_raw.table1_audit add column ddl_column text;")
+	assert.NoError(t, alterErr)
+
+	row = tx.QueryRow(`SELECT EXISTS (
+			SELECT 1
+			FROM audit.ddl_history
+			WHERE object_identity = 'teststar_audit_raw.table1_audit'
+			) AS exists`)
+
+	c = column{}
+	scanErr = row.Scan(&c.exists)
+	assert.NoError(t, scanErr)
+	assert.Equal(t, "false", c.exists.String)
+}
+
+func TestJSONBPayloadEngine(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	config.PayloadEngine = "jsonb"
+	config.IncludedTables = []string{"teststar.table_jsonb"}
+
+	_, errRun := RunAll(db, &config)
+	assert.NoError(t, errRun)
+
+	tx, txErr := db.Begin()
+	assert.NoError(t, txErr)
+	defer tx.Rollback()
+
+	// act
+	_, insertErr := tx.Exec(`insert into teststar.table_jsonb values (1, 1.5, true, '{"a": 1}', '{x,y}');`)
+	assert.NoError(t, insertErr)
+
+	_, updateErr := tx.Exec(`update teststar.table_jsonb set amount = 2.5, active = false, tags = '{x,"y z"}';`)
+	assert.NoError(t, updateErr)
+
+	row := tx.QueryRow("select before_change, change from teststar_audit_raw.table_jsonb_audit where operation = 'U' order by 1 desc limit 1;")
+
+	// assertions
+	c := column{}
+	scanErr := row.Scan(&c.beforeChange, &c.change)
+	assert.NoError(t, scanErr)
+	assert.Equal(t, `{"tags": ["x", "y"], "active": true, "amount": 1.5}`, c.beforeChange.String)
+	assert.Equal(t, `{"tags": ["x", "y z"], "active": false, "amount": 2.5}`, c.change.String)
+
+	var oldTags, newTags sql.NullString
+	row = tx.QueryRow("select old_tags, new_tags from teststar_audit.table_jsonb_audit_compare where audited_operation = 'U';")
+	scanErr = row.Scan(&oldTags, &newTags)
+	assert.NoError(t, scanErr)
+	assert.Equal(t, "{x,y}", oldTags.String)
+	assert.Equal(t, `{x,"y z"}`, newTags.String)
+}
+
+func TestStoreFullRow(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	storeFullRow := true
+	config.IncludedTables = []string{"teststar.table_full_row"}
+	config.Tables = map[string]TableConfig{
+		"teststar.table_full_row": {StoreFullRow: &storeFullRow},
+	}
+
+	_, errRun := RunAll(db, &config)
+	assert.NoError(t, errRun)
+
+	tx, txErr := db.Begin()
+	assert.NoError(t, txErr)
+	defer tx.Rollback()
+
+	// act
+	_, insertErr := tx.Exec("insert into teststar.table_full_row values (1, 'some value');")
+	assert.NoError(t, insertErr)
+
+	_, updateErr := tx.Exec("update teststar.table_full_row set column2 = 'some other value';")
+	assert.NoError(t, updateErr)
+
+	_, deleteErr := tx.Exec("delete from teststar.table_full_row;")
+	assert.NoError(t, deleteErr)
+
+	// assertions
+	var afterChange sql.NullString
+	row := tx.QueryRow("select after_change from teststar_audit_raw.table_full_row_audit where operation = 'I' order by 1 desc limit 1;")
+	scanErr := row.Scan(&afterChange)
+	assert.NoError(t, scanErr)
+	assert.Equal(t, `{"id": "1", "column2": "some value", "updated_by": null}`, afterChange.String)
+
+	c := column{}
+	row = tx.QueryRow("select column2 from teststar_audit.table_full_row_audit_snapshot where audited_operation = 'I';")
+	scanErr = row.Scan(&c.column2)
+	assert.NoError(t, scanErr)
+	assert.Equal(t, "some value", c.column2.String)
+
+	c = column{}
+	row = tx.QueryRow("select old_id, new_id, old_column2, new_column2 from teststar_audit.table_full_row_audit_compare where audited_operation = 'U';")
+	scanErr = row.Scan(&c.oldID, &c.newID, &c.oldColumn2, &c.newColumn2)
+	assert.NoError(t, scanErr)
+	assert.Equal(t, 1, int(c.oldID.Int64))
+	assert.Equal(t, 1, int(c.newID.Int64))
+	assert.Equal(t, "some value", c.oldColumn2.String)
+	assert.Equal(t, "some other value", c.newColumn2.String)
+}
+
+func TestSkipNoopUpdates(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	config.SkipNoopUpdates = true
+	config.IncludedTables = []string{"teststar.table_noop"}
+	config.Tables = map[string]TableConfig{
+		"teststar.table_noop": {IgnoredColumns: []string{"updated_at"}},
+	}
+
+	_, errRun := RunAll(db, &config)
+	assert.NoError(t, errRun)
+
+	tx, txErr := db.Begin()
+	assert.NoError(t, txErr)
+	defer tx.Rollback()
+
+	_, insertErr := tx.Exec("insert into teststar.table_noop values (1, 'some value', now());")
+	assert.NoError(t, insertErr)
+
+	// act
+	_, updateErr := tx.Exec("update teststar.table_noop set column2 = column2;")
+	assert.NoError(t, updateErr)
+
+	_, updateErr = tx.Exec("update teststar.table_noop set updated_at = updated_at + interval '1 minute';")
+	assert.NoError(t, updateErr)
+
+	_, updateErr = tx.Exec("update teststar.table_noop set column2 = 'some other value', updated_at = updated_at + interval '1 minute';")
+	assert.NoError(t, updateErr)
+
+	row := tx.QueryRow("select count(*) from teststar_audit_raw.table_noop_audit where operation = 'U';")
+
+	// assertion
+	c := column{}
+	scanErr := row.Scan(&c.count)
+	assert.NoError(t, scanErr)
+	assert.Equal(t, 1, int(c.count.Int64))
+}
+
+func TestTableOverrides(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	config.IncludedTables = []string{"teststar.table_override"}
+	config.Tables = map[string]TableConfig{
+		"teststar.table_over*":    {Security: "invoker", ExcludedColumns: []string{"secret"}, ValueMaxLength: 100},
+		"teststar.table_override": {ValueMaxLength: 4},
+	}
+
+	_, errRun := RunAll(db, &config)
+	assert.NoError(t, errRun)
+
+	tx, txErr := db.Begin()
+	assert.NoError(t, txErr)
+	defer tx.Rollback()
+
+	_, insertErr := tx.Exec("insert into teststar.table_override values (1, 'some value', 'hunter2');")
+	assert.NoError(t, insertErr)
+
+	// act
+	_, updateErr := tx.Exec("update teststar.table_override set column2 = 'some other value', secret = 'hunter3';")
+	assert.NoError(t, updateErr)
+
+	row := tx.QueryRow(`select before_change->>'column2', before_change ? 'secret' or change ? 'secret'
+		from teststar_audit_raw.table_override_audit where operation = 'U';`)
+
+	// assertion
+	c := column{}
+	scanErr := row.Scan(&c.column2, &c.exists)
+	assert.NoError(t, scanErr)
+	assert.Equal(t, "some", c.column2.String)
+	assert.Equal(t, "false", c.exists.String)
+
+	row = tx.QueryRow(`SELECT prosecdef FROM pg_proc WHERE proname = 'audit_teststar_table_override';`)
+	scanErr = row.Scan(&c.exists)
+	assert.NoError(t, scanErr)
+	assert.Equal(t, "false", c.exists.String)
+}
+
+func TestHashChain(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	config.IncludedTables = []string{"teststar.table_chain"}
+	config.Tables = map[string]TableConfig{
+		"teststar.table_chain": {HashChain: &[]bool{true}[0]},
+	}
+
+	_, err := RunAll(db, &config)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	assert.NoError(t, err)
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`SET LOCAL TimeZone TO 'America/Chicago';
+		insert into teststar.table_chain values (1, 'some value'), (2, 'some value');
+		update teststar.table_chain set column2 = 'some other value' where id = 1;
+		delete from teststar.table_chain where id = 2;`)
+	assert.NoError(t, err)
+
+	// act
+	p := NewProvisioner(config)
+	chains, err := p.VerifyChains(ctx, tx)
+
+	// assertion
+	assert.NoError(t, err)
+	assert.Len(t, chains, 1)
+	assert.True(t, chains[0].Valid)
+	assert.Equal(t, int64(4), chains[0].Rows)
+
+	// rewriting a row breaks the chain at that row
+	_, err = tx.Exec(`ALTER TABLE teststar_audit_raw.table_chain_audit DISABLE TRIGGER no_dml_on_audit_table;
+		UPDATE teststar_audit_raw.table_chain_audit SET changed_by = 'someone else' WHERE chain_seq = 3;`)
+	assert.NoError(t, err)
+
+	chains, err = p.VerifyChains(ctx, tx)
+	assert.NoError(t, err)
+	assert.False(t, chains[0].Valid)
+	assert.Equal(t, int64(3), chains[0].BrokenAt)
+	assert.Equal(t, "row_hash does not match the content of the row", chains[0].Problem)
+
+	// removing a row leaves a gap in the chain
+	_, err = tx.Exec(`DELETE FROM teststar_audit_raw.table_chain_audit WHERE chain_seq IN (2, 3);`)
+	assert.NoError(t, err)
+
+	chains, err = p.VerifyChains(ctx, tx)
+	assert.NoError(t, err)
+	assert.False(t, chains[0].Valid)
+	assert.Equal(t, int64(2), chains[0].BrokenAt)
+	assert.Equal(t, "row is missing", chains[0].Problem)
+
+	// writers whose snapshot could miss the head of the chain are rejected
+	repeatable, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	assert.NoError(t, err)
+	defer repeatable.Rollback()
+
+	_, err = repeatable.Exec(`insert into teststar.table_chain values (3, 'some value');`)
+	assert.EqualError(t, err, "pq: hash chained audit table teststar_audit_raw.table_chain_audit needs writers at READ COMMITTED, not REPEATABLE READ")
+}
+
+func TestPurge(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	config.IncludedTables = []string{"teststar.table_chain"}
+	config.MaintenanceRole = "test__owner"
+	config.Tables = map[string]TableConfig{
+		"teststar.table_chain": {HashChain: &[]bool{true}[0], Retention: "1 day"},
+	}
+	_, err := RunAll(db, &config)
+	assert.NoError(t, err)
+	defer func() {
+		config.MaintenanceRole = ""
+		_, err := RunAll(db, &config)
+		assert.NoError(t, err)
+	}()
+
+	ctx := context.Background()
+	p := NewProvisioner(config)
+	tx, err := db.BeginTx(ctx, nil)
+	assert.NoError(t, err)
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`insert into teststar.table_chain values (301, 'some value'), (302, 'some value'), (303, 'some value');`)
+	assert.NoError(t, err)
+
+	var head int64
+	err = tx.QueryRow(`SELECT max(chain_seq) FROM teststar_audit_raw.table_chain_audit`).Scan(&head)
+	assert.NoError(t, err)
+
+	// only the row before the head is within the retention
+	_, err = tx.Exec(`ALTER TABLE teststar_audit_raw.table_chain_audit DISABLE TRIGGER no_dml_on_audit_table`)
+	assert.NoError(t, err)
+	_, err = tx.Exec(`UPDATE teststar_audit_raw.table_chain_audit SET changed_at = now() - '2 days'::INTERVAL WHERE chain_seq <> $1`, head-1)
+	assert.NoError(t, err)
+	_, err = tx.Exec(`ALTER TABLE teststar_audit_raw.table_chain_audit ENABLE TRIGGER no_dml_on_audit_table`)
+	assert.NoError(t, err)
+
+	// act
+	err = p.Purge(ctx, tx)
+
+	// assertion
+	assert.NoError(t, err)
+
+	var remaining string
+	err = tx.QueryRow(`SELECT string_agg(chain_seq::TEXT, ',' ORDER BY chain_seq) FROM teststar_audit_raw.table_chain_audit`).Scan(&remaining)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%d,%d", head-1, head), remaining)
+
+	// purged rows are logged as maintenance without their content
+	var logged, oldRows int
+	err = tx.QueryRow(`SELECT count(*), count(old_row) FROM audit.maintenance_log
+		WHERE transaction_id = txid_current() AND reason = 'retention 1 day' AND operation = 'DELETE'`).Scan(&logged, &oldRows)
+	assert.NoError(t, err)
+	assert.NotZero(t, logged)
+	assert.Equal(t, 0, oldRows)
+
+	// the head of the chain is kept when every row is past the retention
+	_, err = tx.Exec(`ALTER TABLE teststar_audit_raw.table_chain_audit DISABLE TRIGGER no_dml_on_audit_table`)
+	assert.NoError(t, err)
+	_, err = tx.Exec(`UPDATE teststar_audit_raw.table_chain_audit SET changed_at = now() - '2 days'::INTERVAL`)
+	assert.NoError(t, err)
+	_, err = tx.Exec(`ALTER TABLE teststar_audit_raw.table_chain_audit ENABLE TRIGGER no_dml_on_audit_table`)
+	assert.NoError(t, err)
+
+	err = p.Purge(ctx, tx)
+	assert.NoError(t, err)
+
+	err = tx.QueryRow(`SELECT string_agg(chain_seq::TEXT, ',' ORDER BY chain_seq) FROM teststar_audit_raw.table_chain_audit`).Scan(&remaining)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprint(head), remaining)
+}
+
+func TestCheckpoints(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	assert.NoError(t, err)
+	keyFile, err := ioutil.TempFile("", "checkpoint_key")
+	assert.NoError(t, err)
+	defer os.Remove(keyFile.Name())
+	assert.NoError(t, pem.Encode(keyFile, &pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	keyFile.Close()
+
+	config.IncludedTables = []string{"teststar.table_chain"}
+	config.Tables = map[string]TableConfig{
+		"teststar.table_chain": {HashChain: &[]bool{true}[0]},
+	}
+	config.CheckpointKey = keyFile.Name()
+	config.CheckpointFile = keyFile.Name() + ".jsonl"
+	defer os.Remove(config.CheckpointFile)
+
+	_, err = RunAll(db, &config)
+	assert.NoError(t, err)
+	_, err = db.Exec(`insert into teststar.table_chain values (10, 'some value'), (11, 'some value');`)
+	assert.NoError(t, err)
+
+	// act
+	ctx := context.Background()
+	p := NewProvisioner(config)
+	checkpoint, err := p.Checkpoint(ctx, db)
+
+	// assertion
+	assert.NoError(t, err)
+	assert.Len(t, checkpoint.Tables, 1)
+	assert.True(t, checkpoint.Tables[0].HeadSeq >= 2)
+
+	statuses, err := p.VerifyCheckpoints(ctx, db)
+	assert.NoError(t, err)
+	assert.Len(t, statuses, 1)
+	assert.True(t, statuses[0].Valid)
+
+	// removing the head of the chain is caught, even though the chain left
+	// behind is intact
+	tx, err := db.BeginTx(ctx, nil)
+	assert.NoError(t, err)
+	defer tx.Rollback()
+	_, err = tx.Exec(`ALTER TABLE teststar_audit_raw.table_chain_audit DISABLE TRIGGER no_dml_on_audit_table`)
+	assert.NoError(t, err)
+	_, err = tx.Exec(`DELETE FROM teststar_audit_raw.table_chain_audit WHERE chain_seq = $1`, checkpoint.Tables[0].HeadSeq)
+	assert.NoError(t, err)
+
+	statuses, err = p.VerifyCheckpoints(ctx, tx)
+	assert.NoError(t, err)
+	assert.False(t, statuses[0].Valid)
+	assert.Equal(t, fmt.Sprintf("row at chain_seq %d was removed", checkpoint.Tables[0].HeadSeq), statuses[0].Problem)
+
+	// checkpoints signed with another key are rejected
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	_, err = ReadCheckpoints(config.CheckpointFile, otherKey.Public().(ed25519.PublicKey))
+	assert.EqualError(t, err, config.CheckpointFile+" line 1: signature does not match the checkpoint")
+}
+
+func TestMaintenance(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	config.IncludedTables = []string{"teststar.table1"}
+	config.MaintenanceRole = "test__owner"
+	_, err := RunAll(db, &config)
+	assert.NoError(t, err)
+	defer func() {
+		config.MaintenanceRole = ""
+		_, err := RunAll(db, &config)
+		assert.NoError(t, err)
+	}()
+
+	ctx := context.Background()
+	p := NewProvisioner(config)
+	tx, err := db.BeginTx(ctx, nil)
+	assert.NoError(t, err)
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`insert into teststar.table1 values (100, 'bad backfill');`)
+	assert.NoError(t, err)
+
+	// act
+	err = p.Maintenance(ctx, tx, "ticket 42: bad backfill", `DELETE FROM teststar_audit_raw.table1_audit WHERE primary_key = '100'`)
+
+	// assertion
+	assert.NoError(t, err)
+
+	var operation, reason, performedBy string
+	err = tx.QueryRow(`SELECT operation, reason, performed_by FROM audit.maintenance_log
+		WHERE transaction_id = txid_current() AND table_name = 'table1_audit'`).Scan(&operation, &reason, &performedBy)
+	assert.NoError(t, err)
+	assert.Equal(t, "DELETE", operation)
+	assert.Equal(t, "ticket 42: bad backfill", reason)
+	assert.Equal(t, "postgres", performedBy)
+
+	// entries are only written by the no-DML function
+	var canInsert bool
+	err = tx.QueryRow(`SELECT has_table_privilege('test__owner', 'audit.maintenance_log', 'INSERT')`).Scan(&canInsert)
+	assert.NoError(t, err)
+	assert.False(t, canInsert)
+
+	// the rest of the transaction is protected again
+	_, err = tx.Exec(`DELETE FROM teststar_audit_raw.table1_audit`)
+	assert.Error(t, err)
+
+	err = p.Maintenance(ctx, db, " ", `DELETE FROM teststar_audit_raw.table1_audit`)
+	assert.EqualError(t, err, "maintenance needs a reason")
+}
+
+func TestErase(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	config.IncludedTables = []string{"teststar.table1", "teststar.table2"}
+	config.MaintenanceRole = "test__owner"
+	config.Tables = map[string]TableConfig{
+		"teststar.table1": {PersonalColumns: []string{"column2"}},
+		"teststar.table2": {PersonalColumns: []string{"column3"}},
+	}
+	_, err := RunAll(db, &config)
+	assert.NoError(t, err)
+	defer func() {
+		config.MaintenanceRole = ""
+		_, err := RunAll(db, &config)
+		assert.NoError(t, err)
+	}()
+
+	ctx := context.Background()
+	p := NewProvisioner(config)
+	tx, err := db.BeginTx(ctx, nil)
+	assert.NoError(t, err)
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`insert into teststar.table1 values (101, 'jane@example.com', 1.50);
+		update teststar.table1 set column2 = 'jane.doe@example.com', column3 = 2.50 where id = 101;
+		insert into teststar.table2 values (101, 7, 'jane@example.com');
+		update teststar.table2 set column3 = 'jane.doe@example.com' where id = 101;`)
+	assert.NoError(t, err)
+
+	var key2 string
+	err = tx.QueryRow(`SELECT primary_key FROM teststar_audit_raw.table2_audit ORDER BY table2_audit_id DESC LIMIT 1`).Scan(&key2)
+	assert.NoError(t, err)
+
+	// act
+	erased, err := p.Erase(ctx, tx, []ErasureTarget{
+		{Table: "teststar.table1", PrimaryKey: "101"},
+		{Table: "teststar.table2", PrimaryKey: key2},
+	}, "right to erasure")
+
+	// assertion
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{2, 2}, erased)
+
+	var beforeChange, change string
+	err = tx.QueryRow(`SELECT before_change::TEXT, change::TEXT FROM teststar_audit_raw.table1_audit
+		WHERE primary_key = '101' AND operation = 'U'`).Scan(&beforeChange, &change)
+	assert.NoError(t, err)
+	assert.NotContains(t, beforeChange, "jane")
+	assert.Contains(t, beforeChange, "[redacted]")
+	assert.Contains(t, beforeChange, "1.50")
+	assert.NotContains(t, change, "jane")
+
+	err = tx.QueryRow(`SELECT before_change::TEXT FROM teststar_audit_raw.table2_audit
+		WHERE primary_key = $1 AND operation = 'U'`, key2).Scan(&beforeChange)
+	assert.NoError(t, err)
+	assert.NotContains(t, beforeChange, "jane")
+
+	var logged int
+	var oldRows int
+	err = tx.QueryRow(`SELECT count(*), count(old_row) FROM audit.maintenance_log
+		WHERE transaction_id = txid_current() AND reason = 'right to erasure'`).Scan(&logged, &oldRows)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, logged)
+	assert.Equal(t, 0, oldRows)
+
+	_, err = p.Erase(ctx, tx, []ErasureTarget{{Table: "teststar.table3", PrimaryKey: "101"}}, "right to erasure")
+	assert.EqualError(t, err, "no personal_columns are set for teststar.table3")
+}
+
+func TestEraseHashChain(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	config.IncludedTables = []string{"teststar.table_chain"}
+	config.MaintenanceRole = "test__owner"
+	config.Tables = map[string]TableConfig{
+		"teststar.table_chain": {HashChain: &[]bool{true}[0], PersonalColumns: []string{"column2"}},
+	}
+	_, err := RunAll(db, &config)
+	assert.NoError(t, err)
+	defer func() {
+		config.MaintenanceRole = ""
+		_, err := RunAll(db, &config)
+		assert.NoError(t, err)
+	}()
+
+	ctx := context.Background()
+	p := NewProvisioner(config)
+	tx, err := db.BeginTx(ctx, nil)
+	assert.NoError(t, err)
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`insert into teststar.table_chain values (201, 'jane@example.com'), (202, 'john@example.com');
+		update teststar.table_chain set column2 = 'john.doe@example.com' where id = 202;`)
+	assert.NoError(t, err)
+
+	var lastSeq int64
+	err = tx.QueryRow(`SELECT max(chain_seq) FROM teststar_audit_raw.table_chain_audit`).Scan(&lastSeq)
+	assert.NoError(t, err)
+
+	// act
+	_, err = p.Erase(ctx, tx, []ErasureTarget{{Table: "teststar.table_chain", PrimaryKey: "201"}}, "right to erasure")
+	assert.NoError(t, err)
+	chains, err := p.VerifyChains(ctx, tx)
+
+	// assertion
+	assert.NoError(t, err)
+	assert.False(t, chains[0].Valid)
+	assert.Equal(t, int64(1), chains[0].Maintained)
+	assert.Zero(t, chains[0].BrokenAt)
+	assert.Equal(t, fmt.Sprintf("1 of %d rows maintained, unverified", chains[0].Rows), chains[0].Problem)
+
+	// rows after the erased one are still checked
+	_, err = tx.Exec(`ALTER TABLE teststar_audit_raw.table_chain_audit DISABLE TRIGGER no_dml_on_audit_table`)
+	assert.NoError(t, err)
+	_, err = tx.Exec(`UPDATE teststar_audit_raw.table_chain_audit SET changed_by = 'someone else' WHERE chain_seq = $1`, lastSeq)
+	assert.NoError(t, err)
+
+	chains, err = p.VerifyChains(ctx, tx)
+	assert.NoError(t, err)
+	assert.False(t, chains[0].Valid)
+	assert.Equal(t, lastSeq, chains[0].BrokenAt)
+	assert.Equal(t, "row_hash does not match the content of the row", chains[0].Problem)
+}
+
+func TestRowSecurity(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	config.IncludedTables = []string{"teststar.table1"}
+	config.Grants = []GrantConfig{
+		{Role: "not_test__owner", Scopes: []string{ScopeRawTables, ScopeViews}},
+		{Role: "definitely_not_test__owner", Scopes: []string{ScopeRawTables, ScopeViews}},
+	}
+	config.RowSecurity = true
+	_, err := RunAll(db, &config)
+	assert.NoError(t, err)
+	defer func() {
+		config.RowSecurity = false
+		config.Grants = nil
+		_, err := RunAll(db, &config)
+		assert.NoError(t, err)
+	}()
+
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`SELECT set_config('audit_star.tenant', 'acme', true);
+		insert into teststar.table1 values (102, 'acme row');
+		SELECT set_config('audit_star.tenant', 'globex', true);
+		insert into teststar.table1 values (103, 'globex row');
+		INSERT INTO audit.tenant_members VALUES ('not_test__owner', 'acme');`)
+	assert.NoError(t, err)
+
+	count := func(role, tenants, relation string) int {
+		var n int
+		_, err := tx.Exec(`SET LOCAL ROLE ` + role)
+		assert.NoError(t, err)
+		_, err = tx.Exec(`SELECT set_config('audit_star.tenant', $1, true)`, tenants)
+		assert.NoError(t, err)
+		err = tx.QueryRow(`SELECT count(*) FROM ` + relation + ` WHERE primary_key IN ('102', '103')`).Scan(&n)
+		assert.NoError(t, err)
+		return n
+	}
+
+	// assertion: members see the rows of their tenants only
+	assert.Equal(t, 1, count("not_test__owner", "", "teststar_audit_raw.table1_audit"))
+	assert.Equal(t, 1, count("not_test__owner", "", "teststar_audit.table1_audit_delta"))
+	assert.Equal(t, 1, count("not_test__owner", "", "teststar_audit.table1_audit_snapshot"))
+
+	// assertion: setting the tenant setting does not widen what a reader sees
+	assert.Equal(t, 1, count("not_test__owner", "acme,globex", "teststar_audit_raw.table1_audit"))
+	assert.Equal(t, 1, count("not_test__owner", "acme,globex", "teststar_audit.table1_audit_compare"))
+	assert.Equal(t, 0, count("definitely_not_test__owner", "acme", "teststar_audit_raw.table1_audit"))
+	assert.Equal(t, 0, count("definitely_not_test__owner", "acme", "teststar_audit.table1_audit_delta"))
+
+	// assertion: readers cannot add themselves to a tenant
+	_, err = tx.Exec(`INSERT INTO audit.tenant_members VALUES ('definitely_not_test__owner', 'acme')`)
+	assert.Error(t, err)
+}
+
+func TestStatusAndRemove(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	config.IncludedTables = []string{"teststar.table1", "teststar.table_override"}
+
+	// act
+	statuses, err := Status(db, &config)
+	assert.NoError(t, err)
+
+	// assertion
+	found := 0
+	for _, status := range statuses {
+		switch status.Schema + "." + status.Table {
+		case "teststar.table1":
+			found++
+			assert.True(t, status.Selected)
+			assert.True(t, status.AuditTable)
+			assert.True(t, status.Function)
+			assert.Equal(t, "enabled", status.Trigger)
+			assert.True(t, status.Views)
+			assert.Equal(t, "none", status.Action)
+			assert.False(t, status.Drift)
+		case "teststar.table_skipme":
+			found++
+			assert.False(t, status.Selected)
+			assert.False(t, status.Drift)
+		}
+	}
+	assert.Equal(t, 2, found)
+
+	// removing keeps the audit table but drops everything else
+	config.IncludedTables = []string{"teststar.table_override"}
+	err = Remove(db, &config)
+	assert.NoError(t, err)
+	defer func() {
+		_, err := RunAll(db, &config)
+		assert.NoError(t, err)
+	}()
+
+	plan, err := Plan(db, &config)
+	assert.NoError(t, err)
+	assert.Len(t, plan, 1)
+	assert.True(t, plan[0].AuditTable)
+	assert.False(t, plan[0].Function)
+	assert.Equal(t, "missing", plan[0].Trigger)
+	assert.False(t, plan[0].Views)
+	assert.Equal(t, "repair", plan[0].Action)
+}
+
+func TestRunReport(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	config.IncludedTables = []string{"teststar.table1", "teststar.table2"}
+
+	var buf bytes.Buffer
+	jsonLogger, err := NewLogger(&buf, "json", LevelInfo)
+	assert.NoError(t, err)
+	p := NewProvisioner(config)
+	p.SetLogger(jsonLogger)
+
+	// act
+	report, err := p.Apply(context.Background(), db)
+	assert.NoError(t, err)
+
+	// assertion
+	outcomes := map[string]TableOutcome{}
+	for _, outcome := range report.Tables {
+		outcomes[outcome.Schema+"."+outcome.Table] = outcome
+	}
+	assert.Equal(t, "audit_star", report.Database)
+	assert.Equal(t, OutcomeProvisioned, outcomes["teststar.table1"].Outcome)
+	assert.Equal(t, OutcomeSkippedNoPK, outcomes["teststar.table2"].Outcome)
+	assert.Equal(t, OutcomeSkippedFilter, outcomes["teststar.table_skipme"].Outcome)
+	assert.Equal(t, "excluded_tables: teststar.table_skipme", outcomes["teststar.table_skipme"].Rule)
+
+	// every log line is a JSON object with the fields of its step
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+		if entry["step"] == "function" && entry["table"] == "table1" {
+			found = true
+			assert.Equal(t, "info", entry["level"])
+			assert.Equal(t, "teststar", entry["schema"])
+			assert.Contains(t, entry, "duration")
+		}
+	}
+	assert.True(t, found)
+
+	// the report file lists the tables in order
+	file, err := ioutil.TempFile("", "report_*.json")
+	assert.NoError(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	err = WriteReports(file.Name(), []*RunReport{report})
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(file.Name())
+	assert.NoError(t, err)
+	var written []RunReport
+	assert.NoError(t, json.Unmarshal(data, &written))
+	assert.Len(t, written, 1)
+	assert.Equal(t, len(report.Tables), len(written[0].Tables))
+}
+
+func TestContinueOnError(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	config.IncludedTables = []string{"teststar.table1", "teststar.table3"}
+	config.Tables = map[string]TableConfig{
+		"teststar.table1": {Grantee: "no_such_role"},
+	}
+
+	// act
+	report, err := RunAll(db, &config)
+
+	// assertion: the run stops at the first table which failed
+	var runErr *RunError
+	assert.True(t, errors.As(err, &runErr))
+	assert.Len(t, runErr.Tables, 1)
+	assert.Equal(t, "table1", runErr.Tables[0].Table)
+	assert.Contains(t, runErr.Tables[0].Err.Error(), "no_such_role")
+	assert.Equal(t, 0, report.Count(OutcomeProvisioned))
+
+	// act
+	config.ContinueOnError = true
+	report, err = RunAll(db, &config)
+
+	// assertion: every other table is still provisioned
+	assert.True(t, errors.As(err, &runErr))
+	assert.Len(t, runErr.Tables, 1)
+	assert.Equal(t, 1, report.Count(OutcomeFailed))
+	assert.Equal(t, 1, report.Count(OutcomeProvisioned))
+
+	// cleanup
+	config.Tables = nil
+	_, err = RunAll(db, &config)
+	assert.NoError(t, err)
+}
+
+func TestForTableInTransaction(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	assert.NoError(t, err)
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`CREATE TABLE teststar.table_migrated (id int PRIMARY KEY, column2 text)`)
+	assert.NoError(t, err)
+
+	// act
+	p, err := NewProvisioner(config).ForTable("teststar.table_migrated")
+	assert.NoError(t, err)
+	report, err := p.Apply(ctx, tx)
+
+	// assertion
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Count(OutcomeProvisioned))
+
+	var triggers int
+	err = tx.QueryRow(`SELECT count(*) FROM pg_trigger WHERE tgrelid = 'teststar.table_migrated'::regclass AND tgname LIKE '%audit_star'`).Scan(&triggers)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, triggers)
+
+	_, err = p.ForTable("teststar")
+	assert.Error(t, err)
+	missing, err := NewProvisioner(config).ForTable("teststar.no_such_table")
+	assert.NoError(t, err)
+	_, err = missing.Apply(ctx, tx)
+	assert.EqualError(t, err, "table teststar.no_such_table does not exist")
+}
+
+func TestInlineArgs(t *testing.T) {
+	query, err := inlineArgs(`SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10`,
+		[]interface{}{"it's", nil, 42, 1.5, true, []byte{0xde, 0xad}, pq.Array([]string{"a", "b,c"}), `back\slash`, int64(7), "ten"})
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT 'it''s', NULL, 42, 1.5, TRUE,  E'\\xdead', '{"a","b,c"}',  E'back\\slash', 7, 'ten'`, query)
+
+	// literals holding placeholders are not replaced again
+	query, err = inlineArgs(`SELECT $1, $2`, []interface{}{"costs $1", "two"})
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT 'costs $1', 'two'`, query)
+
+	_, err = inlineArgs(`SELECT $1`, []interface{}{struct{}{}})
+	assert.Error(t, err)
+}
+
+func TestRender(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	p, err := NewProvisioner(config).ForTable("teststar.table1")
+	assert.NoError(t, err)
+
+	_, err = p.Render(context.Background(), db, false)
+	assert.EqualError(t, err, "rendering runs apply and remove against the database before rolling them back, so it must be a copy")
+
+	// act
+	migration, err := p.Render(context.Background(), db, true)
+
+	// assertion
+	assert.NoError(t, err)
+	assert.Contains(t, migration.Up, `CREATE OR REPLACE FUNCTION "teststar_audit_raw"."audit_teststar_table1"()`)
+	assert.Contains(t, migration.Up, `ON "teststar"."table1"`)
+	assert.NotContains(t, migration.Up, "SAVEPOINT")
+	assert.NotContains(t, migration.Up, "teststar.table2")
+	assert.Contains(t, migration.Down, `DROP TRIGGER IF EXISTS row_audit_star ON "teststar"."table1";`)
+
+	// rendering leaves the database as it was
+	statuses, err := p.Status(context.Background(), db)
+	assert.NoError(t, err)
+	for _, status := range statuses {
+		if status.Schema == "teststar" && status.Table == "table1" {
+			assert.Equal(t, "enabled", status.Trigger)
+		}
+	}
+}
+
 func TestLoggingChangedByInsert(t *testing.T) {
 	tests := []struct {
 		query    string
@@ -777,7 +1876,7 @@ func TestClientQueryDefault(t *testing.T) {
 func TestClientQuery(t *testing.T) {
 	// arrangement
 	var config Config
-	ParseFlags(&config)
+	config.CfgPath = DefaultConfigPath
 	getConfig(&config)
 
 	// Open DB
@@ -786,7 +1885,7 @@ func TestClientQuery(t *testing.T) {
 
 	config.LogClientQuery = true
 
-	errRun := RunAll(db, &config)
+	_, errRun := RunAll(db, &config)
 	assert.NoError(t, errRun)
 
 	tx, txErr := db.Begin()
@@ -937,7 +2036,7 @@ func TestQuoting(t *testing.T) {
 func TestSpecialCharactersOwner(t *testing.T) {
 	// arrangement
 	var config Config
-	ParseFlags(&config)
+	config.CfgPath = DefaultConfigPath
 	getConfig(&config)
 
 	config.Owner = "7357:owner"
@@ -946,7 +2045,7 @@ func TestSpecialCharactersOwner(t *testing.T) {
 	db := setupDB(&config)
 	defer db.Close()
 
-	errRun := RunAll(db, &config)
+	_, errRun := RunAll(db, &config)
 	assert.NoError(t, errRun)
 
 	tx, txErr := db.Begin()
@@ -998,7 +2097,7 @@ func TestSecurityDefinerDefault(t *testing.T) {
 func TestSecurityInvoker(t *testing.T) {
 	// arrangement
 	var config Config
-	ParseFlags(&config)
+	config.CfgPath = DefaultConfigPath
 	getConfig(&config)
 
 	config.Security = "invoker"
@@ -1007,7 +2106,7 @@ func TestSecurityInvoker(t *testing.T) {
 	db := setupDB(&config)
 	defer db.Close()
 
-	errRun := RunAll(db, &config)
+	_, errRun := RunAll(db, &config)
 	assert.NoError(t, errRun)
 
 	tx, txErr := db.Begin()
@@ -1123,14 +2222,14 @@ func TestIncludedTables(t *testing.T) {
 	// arrangement
 	var config Config
 	config.IncludedTables = append(config.IncludedTables, "teststar_2.table2")
-	ParseFlags(&config)
+	config.CfgPath = DefaultConfigPath
 	getConfig(&config)
 
 	// Open DB
 	db := setupDB(&config)
 	defer db.Close()
 
-	errRun := RunAll(db, &config)
+	_, errRun := RunAll(db, &config)
 	assert.NoError(t, errRun)
 
 	tx, txErr := db.Begin()
@@ -1159,14 +2258,14 @@ func TestOnlyIncludedTables(t *testing.T) {
 
 	config.IncludedTables = append(config.IncludedTables, "teststar.table1")
 
-	ParseFlags(&config)
+	config.CfgPath = DefaultConfigPath
 	getConfig(&config)
 
 	// Open DB
 	db := setupDB(&config)
 	defer db.Close()
 
-	errRun := RunAll(db, &config)
+	_, errRun := RunAll(db, &config)
 	assert.NoError(t, errRun)
 
 	tx, txErr := db.Begin()
@@ -1209,7 +2308,7 @@ func TestGrantee(t *testing.T) {
 
 	config.Grantee = "audit_data_role"
 
-	ParseFlags(&config)
+	config.CfgPath = DefaultConfigPath
 	getConfig(&config)
 
 	// Open DB
@@ -1218,7 +2317,7 @@ func TestGrantee(t *testing.T) {
 
 	db.Exec("CREATE ROLE audit_data_role;")
 
-	errRun := RunAll(db, &config)
+	_, errRun := RunAll(db, &config)
 	assert.NoError(t, errRun)
 
 	tx, txErr := db.Begin()
@@ -1227,6 +2326,152 @@ func TestGrantee(t *testing.T) {
 	defer tx.Rollback()
 }
 
+func TestActorSources(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	config.IncludedTables = []string{"teststar.table1"}
+	config.ActorSources = []ActorSource{
+		{Setting: "request.jwt.claims", Path: "sub"},
+		{Setting: "application_name"},
+	}
+	_, err := RunAll(db, &config)
+	assert.NoError(t, err)
+	defer func() {
+		config.ActorSources = nil
+		_, err := RunAll(db, &config)
+		assert.NoError(t, err)
+	}()
+
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	defer tx.Rollback()
+
+	// act
+	_, err = tx.Exec(`SELECT set_config('request.jwt.claims', '{"sub": "a-rather-long-subject-claim-from-the-identity-provider-42", "role": "support"}', true);
+		insert into teststar.table1 values (104, 'jwt');
+		SELECT set_config('request.jwt.claims', 'not json', true);
+		SET LOCAL application_name = 'billing-worker';
+		update teststar.table1 set column2 = 'application_name' where id = 104;`)
+	assert.NoError(t, err)
+
+	// assertion
+	var changedBy, role string
+	err = tx.QueryRow(`SELECT changed_by, actor_context -> 'request.jwt.claims' ->> 'role' FROM teststar_audit_raw.table1_audit
+		WHERE primary_key = '104' AND operation = 'I'`).Scan(&changedBy, &role)
+	assert.NoError(t, err)
+	assert.Equal(t, "a-rather-long-subject-claim-from-the-identity-provider-42", changedBy)
+	assert.Equal(t, "support", role)
+
+	var claims string
+	err = tx.QueryRow(`SELECT changed_by, actor_context ->> 'request.jwt.claims' FROM teststar_audit_raw.table1_audit
+		WHERE primary_key = '104' AND operation = 'U'`).Scan(&changedBy, &claims)
+	assert.NoError(t, err)
+	assert.Equal(t, "billing-worker", changedBy)
+	assert.Equal(t, "not json", claims)
+}
+
+func TestUpdatedByTrigger(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	config.IncludedTables = []string{"teststar.table1"}
+	config.UpdatedBy = UpdatedByConfig{Trigger: true}
+	_, err := RunAll(db, &config)
+	assert.NoError(t, err)
+	defer func() {
+		config.UpdatedBy = UpdatedByConfig{}
+		_, err := RunAll(db, &config)
+		assert.NoError(t, err)
+	}()
+
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	defer tx.Rollback()
+
+	// act
+	_, err = tx.Exec(`SELECT set_config('audit_star.changed_by', 'alice', true);
+		insert into teststar.table1 values (105, 'updated by');`)
+	assert.NoError(t, err)
+
+	// assertion
+	var updatedBy string
+	err = tx.QueryRow(`SELECT updated_by FROM teststar.table1 WHERE id = 105`).Scan(&updatedBy)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", updatedBy)
+
+	// updates which change nothing else keep the previous actor
+	_, err = tx.Exec(`SELECT set_config('audit_star.changed_by', 'bob', true);
+		update teststar.table1 set column2 = column2 where id = 105;`)
+	assert.NoError(t, err)
+	err = tx.QueryRow(`SELECT updated_by FROM teststar.table1 WHERE id = 105`).Scan(&updatedBy)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", updatedBy)
+
+	_, err = tx.Exec(`update teststar.table1 set column2 = 'changed' where id = 105;`)
+	assert.NoError(t, err)
+	err = tx.QueryRow(`SELECT updated_by FROM teststar.table1 WHERE id = 105`).Scan(&updatedBy)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", updatedBy)
+
+	// the trigger needs its column when it is not added
+	addColumn := false
+	config.UpdatedBy = UpdatedByConfig{Column: "last_changed_by", AddColumn: &addColumn, Trigger: true}
+	_, err = RunAll(db, &config)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "teststar.table1 has no last_changed_by column for the updated_by trigger")
+}
+
+func TestGrants(t *testing.T) {
+	// arrangement
+	var config Config
+	config.CfgPath = DefaultConfigPath
+	getConfig(&config)
+
+	config.IncludedTables = []string{"teststar.table1"}
+	config.Grants = []GrantConfig{
+		{Role: "not_test__owner", Scopes: []string{ScopeViews}},
+		{Role: "definitely_not_test__owner", Scopes: []string{ScopeRawTables, ScopeViews}},
+	}
+	defer func() {
+		config.Grants = nil
+		_, err := RunAll(db, &config)
+		assert.NoError(t, err)
+	}()
+
+	privilege := func(role, relation string) bool {
+		var granted bool
+		err := db.QueryRow(`SELECT has_table_privilege($1, $2, 'SELECT')`, role, relation).Scan(&granted)
+		assert.NoError(t, err)
+		return granted
+	}
+
+	// act
+	_, err := RunAll(db, &config)
+
+	// assertion
+	assert.NoError(t, err)
+	assert.True(t, privilege("not_test__owner", "teststar_audit.table1_audit_delta"))
+	assert.False(t, privilege("not_test__owner", "teststar_audit_raw.table1_audit"))
+	assert.True(t, privilege("definitely_not_test__owner", "teststar_audit_raw.table1_audit"))
+
+	// act: grants removed from the config are revoked, running twice changes nothing
+	config.Grants = config.Grants[:1]
+	_, err = RunAll(db, &config)
+	assert.NoError(t, err)
+	_, err = RunAll(db, &config)
+	assert.NoError(t, err)
+
+	// assertion
+	assert.True(t, privilege("not_test__owner", "teststar_audit.table1_audit_compare"))
+	assert.False(t, privilege("definitely_not_test__owner", "teststar_audit_raw.table1_audit"))
+	assert.False(t, privilege("definitely_not_test__owner", "teststar_audit.table1_audit_snapshot"))
+}
+
 func TestAuditTablesDefaultOwner(t *testing.T) {
 	// arrangement
 	tx, txErr := db.Begin()
@@ -1255,7 +2500,7 @@ func TestAuditTablesDefaultOwner(t *testing.T) {
 func TestAuditTablesOwnerSpecified(t *testing.T) {
 	// arrangement
 	var config Config
-	ParseFlags(&config)
+	config.CfgPath = DefaultConfigPath
 	getConfig(&config)
 
 	config.Owner = "not_test__owner"
@@ -1264,7 +2509,7 @@ func TestAuditTablesOwnerSpecified(t *testing.T) {
 	db := setupDB(&config)
 	defer db.Close()
 
-	errRun := RunAll(db, &config)
+	_, errRun := RunAll(db, &config)
 	assert.NoError(t, errRun)
 
 	tx, txErr := db.Begin()
@@ -1294,7 +2539,7 @@ func TestAuditTablesOwnerSpecified(t *testing.T) {
 func TestAuditTablesOwnerNotSpecified(t *testing.T) {
 	// arrangement
 	var config Config
-	ParseFlags(&config)
+	config.CfgPath = DefaultConfigPath
 	getConfig(&config)
 
 	// owner set to nil
@@ -1304,7 +2549,7 @@ func TestAuditTablesOwnerNotSpecified(t *testing.T) {
 	db := setupDB(&config)
 	defer db.Close()
 
-	errRun := RunAll(db, &config)
+	_, errRun := RunAll(db, &config)
 	assert.NoError(t, errRun)
 
 	tx, txErr := db.Begin()
@@ -1332,7 +2577,7 @@ func TestAuditTablesOwnerNotSpecified(t *testing.T) {
 func TestSchemaNotOwnedByConfigOwner(t *testing.T) {
 	// arrangement
 	var config Config
-	ParseFlags(&config)
+	config.CfgPath = DefaultConfigPath
 	getConfig(&config)
 
 	// make sure owner is test__owner
@@ -1342,7 +2587,7 @@ func TestSchemaNotOwnedByConfigOwner(t *testing.T) {
 	db := setupDB(&config)
 	defer db.Close()
 
-	errRun := RunAll(db, &config)
+	_, errRun := RunAll(db, &config)
 	assert.NoError(t, errRun)
 
 	tx, txErr := db.Begin()
@@ -1362,12 +2607,56 @@ func TestSchemaNotOwnedByConfigOwner(t *testing.T) {
 	assert.Equal(t, "false", c.exists.String)
 }
 
-func TestCLITablenameOverride(t *testing.T) {
-	var config Config
-	table := "s.t"
-	flag.Set("table", table)
-	ParseFlags(&config)
-	ParseCLIOverrides(&config)
-	assert.Equal(t, config.IncludedTables, []string{table})
-	assert.True(t, isIncludedTable(table, &config))
+func TestTablePatterns(t *testing.T) {
+	config := Config{
+		ExcludedTables:  []string{"accounting.*_tmp"},
+		ExcludedSchemas: []string{"billing", `re:^etl_\d+$`},
+	}
+
+	tests := []struct {
+		table    string
+		selected bool
+		rule     string
+	}{
+		{table: "accounting.ledger", selected: true, rule: "included_tables is empty"},
+		{table: "accounting.ledger_tmp", selected: false, rule: "excluded_tables: accounting.*_tmp"},
+		{table: "billing.invoices", selected: false, rule: "excluded_schemas: billing"},
+		{table: "billing_v2.invoices", selected: true, rule: "included_tables is empty"},
+		{table: "etl_42.staging", selected: false, rule: `excluded_schemas: re:^etl_\d+$`},
+		{table: "etl_main.staging", selected: true, rule: "included_tables is empty"},
+	}
+
+	for _, test := range tests {
+		selected, rule := selectTable(test.table, &config)
+		assert.Equal(t, test.selected, selected, test.table)
+		assert.Equal(t, test.rule, rule, test.table)
+	}
+
+	// exclusions take precedence over included_tables
+	config.IncludedTables = []string{"accounting.*", "re:billing_v2\\..*"}
+
+	selected, rule := selectTable("accounting.ledger_tmp", &config)
+	assert.False(t, selected)
+	assert.Equal(t, "excluded_tables: accounting.*_tmp", rule)
+
+	selected, rule = selectTable("billing_v2.invoices", &config)
+	assert.True(t, selected)
+	assert.Equal(t, "included_tables: re:billing_v2\\..*", rule)
+
+	selected, rule = selectTable("etl_main.staging", &config)
+	assert.False(t, selected)
+	assert.Equal(t, "not matched by included_tables", rule)
+
+	// regular expressions match the whole name
+	matched, err := matchPattern("re:billing", "billing_v2")
+	assert.NoError(t, err)
+	assert.False(t, matched)
+
+	// invalid patterns fail even when Validate is not called
+	_, err = matchPattern("re:billing(", "billing")
+	assert.Error(t, err)
+
+	config.ExcludedSchemas = []string{"re:billing("}
+	_, err = NewProvisioner(config).Status(context.Background(), db)
+	assert.Error(t, err)
 }
@@ -0,0 +1,275 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ChainStatus is the outcome of walking the hash chain of an audit table,
+// along with the first broken link when it is not valid
+type ChainStatus struct {
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+	Rows   int64  `json:"rows"`
+	// rows changed by maintenance, which match audit.maintenance_log. the
+	// log can be written by a superuser as well as the row, so the chain is
+	// not valid while it has any
+	Maintained int64  `json:"maintained,omitempty"`
+	Valid      bool   `json:"valid"`
+	BrokenAt   int64  `json:"broken_at,omitempty"`
+	Problem    string `json:"problem,omitempty"`
+}
+
+// creates the functions shared by the hash chains of every audit table.
+// rows are hashed as jsonb with a fixed time zone and bytea format, so the
+// hash does not depend on the settings of the session writing or verifying
+// the row
+func createHashChainFunctions(db *session) error {
+	query := `CREATE OR REPLACE FUNCTION audit.chain_hash(audit_row JSONB)
+		RETURNS BYTEA AS
+		$$
+			SELECT sha256(convert_to(jsonb_strip_nulls(audit_row - 'row_hash')::TEXT, 'UTF8'));
+		$$
+		LANGUAGE sql
+		IMMUTABLE;
+
+		CREATE OR REPLACE FUNCTION audit.hash_chain()
+		RETURNS TRIGGER AS
+		$$
+		DECLARE
+			head_seq BIGINT;
+			head_hash BYTEA;
+		BEGIN
+			-- a writer whose snapshot predates the lock would not see the rows
+			-- committed while it waited, and take a chain_seq already taken
+			IF current_setting('transaction_isolation') <> 'read committed' THEN
+				RAISE EXCEPTION 'hash chained audit table %.% needs writers at READ COMMITTED, not %',
+					TG_TABLE_SCHEMA, TG_TABLE_NAME, upper(current_setting('transaction_isolation'))
+				USING HINT = 'Run changes of audited tables with hash_chain set at READ COMMITTED.';
+			END IF;
+
+			-- writers of the table take turns, so every row links to the one
+			-- committed before it. the class id, 'audi' in ASCII, keeps these
+			-- locks apart from the bigint locks of applications
+			PERFORM pg_advisory_xact_lock(1635083369, TG_RELID::INT);
+			EXECUTE format('SELECT chain_seq, row_hash FROM %I.%I WHERE chain_seq IS NOT NULL ORDER BY chain_seq DESC LIMIT 1', TG_TABLE_SCHEMA, TG_TABLE_NAME)
+			INTO head_seq, head_hash;
+
+			NEW.chain_seq = COALESCE(head_seq, 0) + 1;
+			NEW.prev_hash = head_hash;
+			NEW.row_hash = NULL;
+			NEW.row_hash = audit.chain_hash(to_jsonb(NEW));
+			RETURN NEW;
+		END;
+		$$
+		LANGUAGE plpgsql
+		SECURITY DEFINER
+		SET TimeZone = 'UTC'
+		SET bytea_output = 'hex';
+
+		DROP FUNCTION IF EXISTS audit.verify_hash_chain(REGCLASS);
+		CREATE FUNCTION audit.verify_hash_chain(audit_table REGCLASS)
+		RETURNS TABLE(verified_rows BIGINT, maintained_rows BIGINT, broken_seq BIGINT, problem TEXT) AS
+		$$
+		DECLARE
+			r RECORD;
+			last_hash BYTEA = NULL;
+			expected_seq BIGINT = NULL;
+			audit_schema NAME;
+			audit_name NAME;
+		BEGIN
+			verified_rows = 0;
+			maintained_rows = 0;
+			SELECT n.nspname, c.relname INTO audit_schema, audit_name
+			FROM pg_class c
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE c.oid = audit_table;
+
+			-- the oldest rows may have been purged, so the chain is checked
+			-- from its oldest remaining row
+			FOR r IN EXECUTE format('SELECT chain_seq, prev_hash, row_hash, to_jsonb(a) AS audit_row FROM %s a WHERE chain_seq IS NOT NULL ORDER BY chain_seq', audit_table) LOOP
+				IF expected_seq IS NOT NULL AND r.chain_seq <> expected_seq THEN
+					broken_seq = expected_seq;
+					problem = 'row is missing';
+					RETURN NEXT;
+					RETURN;
+				END IF;
+				IF expected_seq IS NOT NULL AND r.prev_hash IS DISTINCT FROM last_hash THEN
+					broken_seq = r.chain_seq;
+					problem = 'prev_hash does not match the row before';
+					RETURN NEXT;
+					RETURN;
+				END IF;
+				IF r.row_hash IS DISTINCT FROM audit.chain_hash(r.audit_row) THEN
+					-- rows changed by maintenance, such as an erasure, keep the
+					-- row_hash the rest of the chain links to. they are counted
+					-- while they are exactly as maintenance_log recorded them,
+					-- but the log does not prove they were not forged
+					IF NOT EXISTS (
+						SELECT 1
+						FROM audit.maintenance_log l
+						WHERE l.schema_name = audit_schema
+						AND l.table_name = audit_name
+						AND l.operation = 'UPDATE'
+						AND (l.new_row ->> 'chain_seq')::BIGINT = r.chain_seq
+						AND audit.chain_hash(l.new_row) = audit.chain_hash(r.audit_row)
+					) THEN
+						broken_seq = r.chain_seq;
+						problem = 'row_hash does not match the content of the row';
+						RETURN NEXT;
+						RETURN;
+					END IF;
+					maintained_rows = maintained_rows + 1;
+				END IF;
+
+				last_hash = r.row_hash;
+				expected_seq = r.chain_seq + 1;
+				verified_rows = verified_rows + 1;
+			END LOOP;
+
+			RETURN NEXT;
+		END;
+		$$
+		LANGUAGE plpgsql
+		SET TimeZone = 'UTC'
+		SET bytea_output = 'hex';`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	db.log.Info("hash chain functions created", Fields{"step": "audit_schema"})
+	return nil
+}
+
+// adds the hash chain columns and trigger to the audit table of a table, or
+// drops the trigger when hash_chain is off. rows written while it was off
+// are left out of the chain
+func setHashChain(schema, table string, enabled bool, db *session) error {
+	start := time.Now()
+	auditSchema := schema + "_audit_raw"
+	data := map[string]interface{}{
+		"auditSchema": auditSchema,
+		"table":       table,
+	}
+
+	query := `DROP TRIGGER IF EXISTS hash_chain_audit_star ON "{{.auditSchema}}"."{{.table}}_audit";`
+	if enabled {
+		for _, column := range [][]string{{"chain_seq", "BIGINT"}, {"prev_hash", "BYTEA"}, {"row_hash", "BYTEA"}} {
+			err := addColToTable(auditSchema, table+"_audit", column[0], column[1], db)
+			if err != nil {
+				return err
+			}
+		}
+
+		query += `CREATE UNIQUE INDEX IF NOT EXISTS "index_{{.table}}_on_chain_seq" ON "{{.auditSchema}}"."{{.table}}_audit"(chain_seq);
+
+			CREATE TRIGGER hash_chain_audit_star
+			BEFORE INSERT ON "{{.auditSchema}}"."{{.table}}_audit"
+			FOR EACH ROW
+			EXECUTE PROCEDURE audit.hash_chain();`
+	}
+
+	query, err := parseQuery(query, data)
+	if err != nil {
+		return err
+	}
+
+	err = db.inTx(func(tx *session) error {
+		_, err := tx.Exec(query)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if !enabled {
+		return nil
+	}
+
+	db.log.Info("hash chain created", Fields{"schema": schema, "table": table, "step": "hash_chain", "duration": time.Since(start)})
+
+	var isolation string
+	err = db.QueryRow(`SELECT current_setting('default_transaction_isolation')`).Scan(&isolation)
+	if err != nil {
+		return err
+	}
+	if isolation != "read committed" {
+		db.log.Warn("hash chained tables reject writers above read committed", Fields{"schema": schema, "table": table, "step": "hash_chain", "default_transaction_isolation": isolation})
+	}
+	return nil
+}
+
+// VerifyChains walks the hash chain of every selected table with hash_chain
+// set, reporting the first broken link of each: a missing row, or one whose
+// content or link to the row before was changed after it was written
+func (p *Provisioner) VerifyChains(ctx context.Context, q Querier) ([]ChainStatus, error) {
+	db, config, err := p.session(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	allSchemas, err := getAllSchemas(db, config)
+	if err != nil {
+		return nil, err
+	}
+
+	allTables, err := getAllTables(db, config, allSchemas)
+	if err != nil {
+		return nil, err
+	}
+
+	chains := []ChainStatus{}
+	for _, tbl := range enabledTables(filterTables(allTables, config)) {
+		schemaTable := strings.SplitN(tbl, ".", 2)
+		schema, table := schemaTable[0], schemaTable[1]
+		if !tableOptionsFor(schema, table, config).hashChain {
+			continue
+		}
+
+		chain, err := verifyChain(schema, table, db)
+		if err != nil {
+			return nil, err
+		}
+		chains = append(chains, chain)
+	}
+
+	return chains, nil
+}
+
+// walks the hash chain of the audit table of one table
+func verifyChain(schema, table string, db *session) (ChainStatus, error) {
+	start := time.Now()
+	chain := ChainStatus{Schema: schema, Table: table}
+
+	chained, err := hasColumn(schema+"_audit_raw", table+"_audit", "chain_seq", db)
+	if err != nil {
+		return chain, err
+	}
+	if !chained {
+		chain.Problem = "not hash chained, apply has not run since hash_chain was set"
+		return chain, nil
+	}
+
+	var brokenSeq *int64
+	var problem *string
+	auditTable := `"` + schema + `_audit_raw"."` + table + `_audit"`
+	err = db.QueryRow(`SELECT verified_rows, maintained_rows, broken_seq, problem FROM audit.verify_hash_chain($1::regclass)`, auditTable).Scan(&chain.Rows, &chain.Maintained, &brokenSeq, &problem)
+	if err != nil {
+		return chain, err
+	}
+
+	chain.Valid = problem == nil && chain.Maintained == 0
+	switch {
+	case problem != nil:
+		chain.BrokenAt = *brokenSeq
+		chain.Problem = *problem
+	case chain.Maintained > 0:
+		chain.Problem = fmt.Sprintf("%d of %d rows maintained, unverified", chain.Maintained, chain.Rows)
+	}
+
+	db.log.Info("verified hash chain", Fields{"schema": schema, "table": table, "step": "verify", "rows": chain.Rows, "maintained": chain.Maintained, "valid": chain.Valid, "duration": time.Since(start)})
+	return chain, nil
+}
@@ -0,0 +1,484 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultCheckpointFile is the file checkpoints are appended to when
+// checkpoint_file is not set
+const DefaultCheckpointFile = "audit_star_checkpoints.jsonl"
+
+// Checkpoint records the state of the audit tables of a database at a point
+// in time
+type Checkpoint struct {
+	ID        int64             `json:"id"`
+	Database  string            `json:"database"`
+	CreatedAt time.Time         `json:"created_at"`
+	Tables    []TableCheckpoint `json:"tables"`
+}
+
+// TableCheckpoint is the state of one audit table: its highest audit id and
+// row count, and the head of its hash chain when it has one
+type TableCheckpoint struct {
+	Schema     string `json:"schema"`
+	Table      string `json:"table"`
+	MaxAuditID int64  `json:"max_audit_id"`
+	Rows       int64  `json:"rows"`
+	HeadSeq    int64  `json:"head_seq,omitempty"`
+	HeadHash   string `json:"head_hash,omitempty"`
+}
+
+// CheckpointStatus is the outcome of checking one table of a checkpoint
+// against its audit table
+type CheckpointStatus struct {
+	Checkpoint int64  `json:"checkpoint"`
+	Schema     string `json:"schema"`
+	Table      string `json:"table"`
+	Valid      bool   `json:"valid"`
+	Problem    string `json:"problem,omitempty"`
+}
+
+// a line of the checkpoint file. the checkpoint is kept as it was signed, so
+// the signature is checked against the exact bytes
+type signedCheckpoint struct {
+	Checkpoint json.RawMessage `json:"checkpoint"`
+	Signature  []byte          `json:"signature"`
+}
+
+// creates the audit.checkpoints table, which rejects updates and deletes like
+// the audit tables do
+func createCheckpointsTable(db *session, c *Config) error {
+	query := `CREATE TABLE IF NOT EXISTS audit.checkpoints(
+			checkpoint_id BIGINT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			schema_name NAME NOT NULL,
+			table_name NAME NOT NULL,
+			max_audit_id BIGINT NOT NULL,
+			row_count BIGINT NOT NULL,
+			head_seq BIGINT,
+			head_hash BYTEA,
+			PRIMARY KEY(checkpoint_id, schema_name, table_name)
+		);
+
+		CREATE SEQUENCE IF NOT EXISTS audit.checkpoints_id_seq;
+
+		DROP TRIGGER IF EXISTS no_dml_on_audit_table ON audit.checkpoints;
+		CREATE TRIGGER no_dml_on_audit_table
+		BEFORE UPDATE OR DELETE ON audit.checkpoints
+		FOR EACH ROW
+		EXECUTE PROCEDURE audit.no_dml_on_audit_table();
+
+		DROP TRIGGER IF EXISTS no_truncate_on_audit ON audit.checkpoints;
+		CREATE TRIGGER no_truncate_on_audit
+		BEFORE TRUNCATE ON audit.checkpoints
+		FOR EACH STATEMENT
+		EXECUTE PROCEDURE audit.no_dml_on_audit_table();`
+
+	err := createAuditSchema(db)
+	if err != nil {
+		return err
+	}
+
+	err = createNoDMLAuditFunction(db, c)
+	if err != nil {
+		return err
+	}
+
+	return db.inTx(func(tx *session) error {
+		_, err := tx.Exec(query)
+		return err
+	})
+}
+
+// Checkpoint records the highest audit id, row count and hash chain head of
+// the audit table of every selected table in audit.checkpoints, and appends
+// the checkpoint signed with checkpoint_key to checkpoint_file once that is
+// committed, so the file never holds a checkpoint the database does not.
+// When the file cannot be written the checkpoint is left unsigned in
+// audit.checkpoints, where verification does not look for it.
+func (p *Provisioner) Checkpoint(ctx context.Context, q Querier) (*Checkpoint, error) {
+	db, config, err := p.session(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if config.CheckpointKey == "" {
+		return nil, errors.New("checkpoint_key is not set")
+	}
+	key, err := readPrivateKey(config.CheckpointKey)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createCheckpointsTable(db, config)
+	if err != nil {
+		return nil, err
+	}
+
+	allSchemas, err := getAllSchemas(db, config)
+	if err != nil {
+		return nil, err
+	}
+
+	allTables, err := getAllTables(db, config, allSchemas)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := &Checkpoint{Database: config.DBName, Tables: []TableCheckpoint{}}
+	err = db.inTx(func(tx *session) error {
+		err := tx.QueryRow(`SELECT nextval('audit.checkpoints_id_seq'), now()`).Scan(&checkpoint.ID, &checkpoint.CreatedAt)
+		if err != nil {
+			return err
+		}
+		checkpoint.CreatedAt = checkpoint.CreatedAt.UTC()
+
+		for _, tbl := range enabledTables(filterTables(allTables, config)) {
+			schemaTable := strings.SplitN(tbl, ".", 2)
+			state, ok, err := tableCheckpoint(schemaTable[0], schemaTable[1], tx)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+
+			var headHash []byte
+			if state.HeadHash != "" {
+				headHash, _ = hex.DecodeString(state.HeadHash)
+			}
+			_, err = tx.Exec(`INSERT INTO audit.checkpoints(checkpoint_id, created_at, schema_name, table_name, max_audit_id, row_count, head_seq, head_hash)
+				VALUES($1, $2, $3, $4, $5, $6, NULLIF($7::BIGINT, 0), $8)`,
+				checkpoint.ID, checkpoint.CreatedAt, state.Schema, state.Table, state.MaxAuditID, state.Rows, state.HeadSeq, headHash)
+			if err != nil {
+				return err
+			}
+			checkpoint.Tables = append(checkpoint.Tables, state)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = appendCheckpoint(config.checkpointFile(), checkpoint, key)
+	if err != nil {
+		return nil, err
+	}
+
+	db.log.Info("recorded checkpoint", Fields{"database": config.DBName, "checkpoint": checkpoint.ID, "tables": len(checkpoint.Tables)})
+	return checkpoint, nil
+}
+
+// returns the state of the audit table of a table, or false when it has none
+func tableCheckpoint(schema, table string, db *session) (TableCheckpoint, bool, error) {
+	state := TableCheckpoint{Schema: schema, Table: table}
+	auditTable := fmt.Sprintf(`"%s_audit_raw"."%s_audit"`, schema, table)
+
+	var exists bool
+	err := db.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, auditTable).Scan(&exists)
+	if err != nil || !exists {
+		return state, false, err
+	}
+
+	query := fmt.Sprintf(`SELECT COALESCE(max("%s_audit_id"), 0), count(*) FROM %s`, table, auditTable)
+	err = db.QueryRow(query).Scan(&state.MaxAuditID, &state.Rows)
+	if err != nil {
+		return state, false, err
+	}
+
+	chained, err := hasColumn(schema+"_audit_raw", table+"_audit", "chain_seq", db)
+	if err != nil || !chained {
+		return state, true, err
+	}
+
+	var headHash []byte
+	query = fmt.Sprintf(`SELECT chain_seq, row_hash FROM %s WHERE chain_seq IS NOT NULL ORDER BY chain_seq DESC LIMIT 1`, auditTable)
+	err = db.QueryRow(query).Scan(&state.HeadSeq, &headHash)
+	if err == sql.ErrNoRows {
+		return state, true, nil
+	}
+	state.HeadHash = hex.EncodeToString(headHash)
+
+	return state, true, err
+}
+
+// VerifyCheckpoints checks the audit tables against every checkpoint of the
+// database in checkpoint_file, after checking the signature of each with
+// checkpoint_public_key. A table is valid when the rows counted by each
+// checkpoint are still there and its hash chain still runs through the head
+// the checkpoint recorded. Tables with a retention lose rows to purges, so
+// their rows are not counted, and their chain head is only checked until
+// it is purged.
+func (p *Provisioner) VerifyCheckpoints(ctx context.Context, q Querier) ([]CheckpointStatus, error) {
+	db, config, err := p.session(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	key, err := config.checkpointPublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoints, err := ReadCheckpoints(config.checkpointFile(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	var recordedExists bool
+	err = db.QueryRow(`SELECT to_regclass('audit.checkpoints') IS NOT NULL`).Scan(&recordedExists)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []CheckpointStatus{}
+	for _, checkpoint := range checkpoints {
+		if checkpoint.Database != config.DBName {
+			continue
+		}
+
+		for _, state := range checkpoint.Tables {
+			status := CheckpointStatus{Checkpoint: checkpoint.ID, Schema: state.Schema, Table: state.Table}
+			retention := tableOptionsFor(state.Schema, state.Table, config).retention
+			status.Problem, err = checkTableCheckpoint(state, checkpoint.ID, recordedExists, retention != "", db)
+			if err != nil {
+				return nil, err
+			}
+			status.Valid = status.Problem == ""
+			statuses = append(statuses, status)
+		}
+	}
+
+	return statuses, nil
+}
+
+// returns what no longer matches the checkpoint of a table, or nothing
+func checkTableCheckpoint(state TableCheckpoint, id int64, recordedExists, purged bool, db *session) (string, error) {
+	auditTable := fmt.Sprintf(`"%s_audit_raw"."%s_audit"`, state.Schema, state.Table)
+
+	// the copy in the database may be changed, the signed file is what counts
+	if !recordedExists {
+		return "audit.checkpoints was dropped", nil
+	}
+
+	var matches bool
+	err := db.QueryRow(`SELECT EXISTS (
+			SELECT 1 FROM audit.checkpoints
+			WHERE checkpoint_id = $1 AND schema_name = $2 AND table_name = $3
+			AND max_audit_id = $4 AND row_count = $5
+			AND COALESCE(encode(head_hash, 'hex'), '') = $6
+		)`, id, state.Schema, state.Table, state.MaxAuditID, state.Rows, state.HeadHash).Scan(&matches)
+	if err != nil {
+		return "", err
+	}
+	if !matches {
+		return "audit.checkpoints does not match the signed checkpoint", nil
+	}
+
+	var exists bool
+	err = db.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, auditTable).Scan(&exists)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "audit table was dropped", nil
+	}
+
+	if state.HeadSeq > 0 {
+		var minSeq sql.NullInt64
+		var headHash []byte
+		query := fmt.Sprintf(`SELECT (SELECT min(chain_seq) FROM %[1]s), (SELECT row_hash FROM %[1]s WHERE chain_seq = $1)`, auditTable)
+		err = db.QueryRow(query, state.HeadSeq).Scan(&minSeq, &headHash)
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case headHash == nil && purged && (!minSeq.Valid || minSeq.Int64 > state.HeadSeq):
+			return "", nil
+		case headHash == nil:
+			return fmt.Sprintf("row at chain_seq %d was removed", state.HeadSeq), nil
+		case hex.EncodeToString(headHash) != state.HeadHash:
+			return fmt.Sprintf("row at chain_seq %d was altered", state.HeadSeq), nil
+		}
+	}
+
+	if purged {
+		return "", nil
+	}
+
+	var rows int64
+	query := fmt.Sprintf(`SELECT count(*) FROM %s WHERE "%s_audit_id" <= $1`, auditTable, state.Table)
+	err = db.QueryRow(query, state.MaxAuditID).Scan(&rows)
+	if err != nil {
+		return "", err
+	}
+	if rows < state.Rows {
+		return fmt.Sprintf("%d of the %d rows up to audit id %d were removed", state.Rows-rows, state.Rows, state.MaxAuditID), nil
+	}
+
+	return "", nil
+}
+
+// ReadCheckpoints returns the checkpoints of the file, in the order they were
+// recorded, once the signature of each has been checked with key
+func ReadCheckpoints(path string, key ed25519.PublicKey) ([]Checkpoint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var checkpoints []Checkpoint
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var signed signedCheckpoint
+		err = json.Unmarshal(scanner.Bytes(), &signed)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		if !ed25519.Verify(key, signed.Checkpoint, signed.Signature) {
+			return nil, fmt.Errorf("%s line %d: signature does not match the checkpoint", path, line)
+		}
+
+		var checkpoint Checkpoint
+		err = json.Unmarshal(signed.Checkpoint, &checkpoint)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+
+	return checkpoints, scanner.Err()
+}
+
+// signs the checkpoint and appends it to the file as a JSON line
+func appendCheckpoint(path string, checkpoint *Checkpoint, key ed25519.PrivateKey) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(signedCheckpoint{Checkpoint: data, Signature: ed25519.Sign(key, data)})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	// the checkpoint must reach the disk before it is reported as recorded
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// returns the file checkpoints are appended to
+func (c *Config) checkpointFile() string {
+	if c.CheckpointFile == "" {
+		return DefaultCheckpointFile
+	}
+	return c.CheckpointFile
+}
+
+// returns the key checkpoints are verified with, taken from the private key
+// when no public key is set
+func (c *Config) checkpointPublicKey() (ed25519.PublicKey, error) {
+	if c.CheckpointPublicKey != "" {
+		return readPublicKey(c.CheckpointPublicKey)
+	}
+	if c.CheckpointKey != "" {
+		key, err := readPrivateKey(c.CheckpointKey)
+		if err != nil {
+			return nil, err
+		}
+		return key.Public().(ed25519.PublicKey), nil
+	}
+
+	return nil, errors.New("neither checkpoint_public_key nor checkpoint_key is set")
+}
+
+// reads an ed25519 private key from a PKCS #8 PEM file, as written by
+// openssl genpkey -algorithm ed25519
+func readPrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", path)
+	}
+
+	return edKey, nil
+}
+
+// reads an ed25519 public key from a PKIX PEM file, as written by
+// openssl pkey -pubout
+func readPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", path)
+	}
+
+	return edKey, nil
+}
+
+func readPEM(path, blockType string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s: expected a PEM %s block", path, blockType)
+	}
+
+	return block, nil
+}
@@ -0,0 +1,208 @@
+package audit
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// DatabaseConfig is one entry of the databases section: either the name of
+// a database, or a mapping of settings which override the top-level ones for
+// that database. Either way db_name may be a pattern matched against the
+// databases of the cluster.
+type DatabaseConfig struct {
+	node yaml.Node
+}
+
+// UnmarshalYAML keeps the entry as it is, it is only decoded once it is
+// applied over the top-level settings
+func (d *DatabaseConfig) UnmarshalYAML(node *yaml.Node) error {
+	d.node = *node
+	return nil
+}
+
+// DatabaseConfigs returns the config of every entry of the databases section,
+// each made of the top-level settings with the entry's settings on top. A
+// config without a databases section is returned as it is.
+func DatabaseConfigs(c *Config) ([]Config, error) {
+	if len(c.Databases) == 0 {
+		return []Config{*c}, nil
+	}
+
+	var configs []Config
+	var problems ConfigErrors
+	for i, entry := range c.Databases {
+		field := fmt.Sprintf("databases[%d]", i)
+
+		dbConfig := *c
+		dbConfig.Databases = nil
+		dbConfig.lines = map[string]int{}
+		for key, line := range c.lines {
+			dbConfig.lines[key] = line
+		}
+
+		// entries add to the tables section instead of sharing its map
+		dbConfig.Tables = map[string]TableConfig{}
+		for key, tc := range c.Tables {
+			dbConfig.Tables[key] = tc
+		}
+
+		node := entry.node
+		switch node.Kind {
+		case yaml.ScalarNode:
+			dbConfig.DBName = node.Value
+			dbConfig.lines["db_name"] = node.Line
+		case yaml.MappingNode:
+			problems = append(problems, unknownKeys(&node, reflect.TypeOf(Config{}), field)...)
+			if err := node.Decode(&dbConfig); err != nil {
+				return nil, decodeErrors(err)
+			}
+			recordLines(&node, "", dbConfig.lines)
+		default:
+			problems = append(problems, ConfigError{
+				Line:    node.Line,
+				Field:   field,
+				Message: "expected a database name or a mapping of settings",
+			})
+		}
+
+		configs = append(configs, dbConfig)
+	}
+
+	if len(problems) > 0 {
+		return configs, problems
+	}
+
+	return configs, nil
+}
+
+// ExpandDatabases replaces every config whose db_name is a pattern with one
+// config per matching database of its cluster. Databases named by several
+// entries are only returned once, for the first of them.
+func ExpandDatabases(configs []Config) ([]Config, error) {
+	var expanded []Config
+	seen := map[string]bool{}
+	for _, c := range configs {
+		names := []string{c.DBName}
+		if isDatabasePattern(c.DBName) {
+			var err error
+			names, err = clusterDatabases(&c)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, name := range names {
+			key := c.Host + ":" + c.Port + "/" + name
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			dbConfig := c
+			dbConfig.DBName = name
+			expanded = append(expanded, dbConfig)
+		}
+	}
+
+	return expanded, nil
+}
+
+// returns true if db_name is a glob or regular expression
+func isDatabasePattern(name string) bool {
+	return strings.HasPrefix(name, "re:") || strings.ContainsAny(name, "*?[")
+}
+
+// returns the databases of the cluster which match the config's db_name,
+// listed through the postgres database
+func clusterDatabases(c *Config) ([]string, error) {
+	listConfig := *c
+	listConfig.DBName = "postgres"
+	dbInfo, err := connString(&listConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("postgres", dbInfo)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	query := `SELECT datname
+		FROM pg_database
+		WHERE datallowconn
+		AND NOT datistemplate
+		ORDER BY datname`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var name string
+	var names []string
+	for rows.Next() {
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		matched, err := matchPattern(c.DBName, name)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			names = append(names, name)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no database matches %s", c.DBName)
+	}
+
+	return names, nil
+}
+
+// reports the keys of a mapping which the struct type it is decoded into
+// does not have, including those of the tables section
+func unknownKeys(node *yaml.Node, t reflect.Type, field string) ConfigErrors {
+	known := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag != "" && tag != "-" {
+			known[tag] = true
+		}
+	}
+	// settings of the whole run
+	for _, key := range []string{"databases", "parallelism", "log_format", "log_level", "report"} {
+		delete(known, key)
+	}
+
+	var problems ConfigErrors
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if !known[key.Value] {
+			problems = append(problems, ConfigError{
+				Line:    key.Line,
+				Field:   field,
+				Message: fmt.Sprintf("field %s not found in type %s", key.Value, t),
+			})
+			continue
+		}
+
+		if key.Value == "tables" && value.Kind == yaml.MappingNode {
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				tableField := field + ".tables[" + value.Content[j].Value + "]"
+				problems = append(problems, unknownKeys(value.Content[j+1], reflect.TypeOf(TableConfig{}), tableField)...)
+			}
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,148 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// the value personal columns are replaced with
+const redacted = "[redacted]"
+
+// ErasureTarget is one row Erase redacts the personal columns of: a table,
+// schema-qualified, and the primary key of the row in its audit table
+type ErasureTarget struct {
+	Table      string `json:"table"`
+	PrimaryKey string `json:"primary_key"`
+}
+
+// Erase redacts the personal columns of rows of tables, as listed by
+// personal_columns in their tables entries, from their audit history. Their
+// values in before_change, change and after_change are replaced with
+// "[redacted]" and the client queries and actor context are dropped, while
+// the operation, timestamps and every other value are kept. A person whose
+// data is held by several tables, each under its own primary key, is erased
+// with one target per table. The targets are erased in one transaction, run
+// as maintenance with the reason given, and recorded in audit.maintenance_log
+// without the values removed. It returns the number of audit rows redacted
+// for each target.
+func (p *Provisioner) Erase(ctx context.Context, q Querier, targets []ErasureTarget, reason string) ([]int64, error) {
+	db, config, err := p.session(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("erasure needs at least one table and primary key")
+	}
+	if strings.TrimSpace(reason) == "" {
+		return nil, errors.New("erasure needs a reason")
+	}
+	if config.MaintenanceRole == "" {
+		return nil, errors.New("maintenance_role is not set")
+	}
+
+	jsonType, err := getSupportedJSONType(db)
+	if err != nil {
+		return nil, err
+	}
+
+	queries := make([]string, len(targets))
+	columns := make([][]string, len(targets))
+	for i, target := range targets {
+		queries[i], columns[i], err = erasureQuery(target.Table, jsonType, db, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	erased := make([]int64, len(targets))
+	err = maintain(db, reason, func(tx *session) error {
+		_, err := tx.Exec(`SELECT set_config('audit_star.log_old_rows', 'off', true)`)
+		if err != nil {
+			return err
+		}
+
+		for i, target := range targets {
+			result, err := tx.Exec(queries[i], target.PrimaryKey, pq.Array(columns[i]), redacted)
+			if err != nil {
+				return fmt.Errorf("%s: %v", target.Table, err)
+			}
+			erased[i], err = result.RowsAffected()
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(`SELECT set_config('audit_star.log_old_rows', '', true)`)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, target := range targets {
+		schemaTable := strings.SplitN(target.Table, ".", 2)
+		db.log.Info("erased personal columns", Fields{"schema": schemaTable[0], "table": schemaTable[1], "step": "erase", "rows": erased[i]})
+	}
+	db.log.Info("erasure finished", Fields{"step": "erase", "targets": len(targets), "duration": time.Since(start)})
+	return erased, nil
+}
+
+// returns the update redacting the personal columns of one row of a table
+// from its audit table, along with those columns
+func erasureQuery(table, jsonType string, db *session, config *Config) (string, []string, error) {
+	schemaTable, err := ParseTableName(table)
+	if err != nil {
+		return "", nil, err
+	}
+	schema, table := schemaTable[0], schemaTable[1]
+
+	columns := tableOptionsFor(schema, table, config).personalColumns
+	if len(columns) == 0 {
+		return "", nil, fmt.Errorf("no personal_columns are set for %s.%s", schema, table)
+	}
+
+	auditTable := fmt.Sprintf(`"%s_audit_raw"."%s_audit"`, schema, table)
+	var exists bool
+	err = db.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, auditTable).Scan(&exists)
+	if err != nil {
+		return "", nil, err
+	}
+	if !exists {
+		return "", nil, fmt.Errorf("%s.%s has no audit table", schema, table)
+	}
+
+	set := []string{"client_query = NULL"}
+	hasContext, err := hasColumn(schema+"_audit_raw", table+"_audit", "actor_context", db)
+	if err != nil {
+		return "", nil, err
+	}
+	if hasContext {
+		set = append(set, "actor_context = NULL")
+	}
+	for _, column := range []string{"before_change", "change", "after_change"} {
+		hasPayload, err := hasColumn(schema+"_audit_raw", table+"_audit", column, db)
+		if err != nil {
+			return "", nil, err
+		}
+		if hasPayload {
+			set = append(set, fmt.Sprintf("%[1]s = %[2]s", column, redactPayload(column, jsonType)))
+		}
+	}
+
+	return fmt.Sprintf(`UPDATE %s SET %s WHERE primary_key = $1`, auditTable, strings.Join(set, ", ")), columns, nil
+}
+
+// returns an expression replacing the values of the personal columns, $2, in
+// a payload column with $3
+func redactPayload(column, jsonType string) string {
+	return fmt.Sprintf(`CASE WHEN %[1]s IS NULL THEN NULL ELSE (
+			SELECT COALESCE(jsonb_object_agg(p.key, CASE WHEN p.key = ANY($2::TEXT[]) THEN to_jsonb($3::TEXT) ELSE p.value END), '{}'::JSONB)
+			FROM jsonb_each(%[1]s::JSONB) p
+		)::%[2]s END`, column, jsonType)
+}
@@ -0,0 +1,78 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// TableError is the failure of a single table, along with its cause
+type TableError struct {
+	Schema string
+	Table  string
+	Err    error
+}
+
+func (e *TableError) Error() string {
+	return fmt.Sprintf("%s.%s: %v", e.Schema, e.Table, e.Err)
+}
+
+func (e *TableError) Unwrap() error {
+	return e.Err
+}
+
+// MarshalJSON writes the cause as its message
+func (e *TableError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{
+		"schema": e.Schema,
+		"table":  e.Table,
+		"error":  e.Err.Error(),
+	})
+}
+
+// RunError lists every table which failed during a run. Unless
+// continue_on_error is set the run stops at the first of them.
+type RunError struct {
+	Tables []*TableError
+}
+
+func (e *RunError) Error() string {
+	if len(e.Tables) == 1 {
+		return e.Tables[0].Error()
+	}
+
+	msgs := make([]string, len(e.Tables))
+	for i, tableErr := range e.Tables {
+		msgs[i] = tableErr.Error()
+	}
+
+	return fmt.Sprintf("%d tables failed:\n  %s", len(e.Tables), strings.Join(msgs, "\n  "))
+}
+
+// collects the tables which failed during a run
+type failures struct {
+	continueOnError bool
+	log             *Logger
+	tables          []*TableError
+}
+
+// records the failure of a table and returns the error the run stops with,
+// or nil when it should carry on
+func (f *failures) add(schema, table string, err error) error {
+	f.tables = append(f.tables, &TableError{Schema: schema, Table: table, Err: err})
+	f.log.Error("failed", Fields{"schema": schema, "table": table, "error": err})
+
+	if f.continueOnError {
+		return nil
+	}
+	return f.err()
+}
+
+// returns a RunError listing the failed tables, or nil when none failed
+func (f *failures) err() error {
+	if len(f.tables) == 0 {
+		return nil
+	}
+
+	return &RunError{Tables: f.tables}
+}
@@ -0,0 +1,227 @@
+package audit
+
+import (
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// the scopes of the grants section: the raw audit tables, the views built
+// on them and the functions of the audit schema
+const (
+	ScopeRawTables = "raw_tables"
+	ScopeViews     = "views"
+	ScopeFunctions = "functions"
+)
+
+var grantScopes = []string{ScopeRawTables, ScopeViews, ScopeFunctions}
+
+// the scope of the grants on audit.tenant_members, made for the readers of
+// tables with row_security rather than listed in the config
+const scopeTenantMembers = "tenant_members"
+
+var tablePrivileges = []string{"SELECT", "INSERT", "UPDATE", "DELETE", "TRUNCATE", "REFERENCES", "TRIGGER"}
+
+var functionPrivileges = []string{"EXECUTE"}
+
+// GrantConfig is one entry of the grants section: a role and the privileges
+// it is given on the objects of some scopes. Privileges default to SELECT on
+// tables and views and EXECUTE on functions.
+type GrantConfig struct {
+	Role       string   `yaml:"role"`
+	Scopes     []string `yaml:"scopes"`
+	Privileges []string `yaml:"privileges"`
+}
+
+// a privilege given to a role on an object, such as TABLE "a"."b" or SCHEMA
+// "a", on behalf of a source: the table whose objects it covers, or audit
+// for the functions
+type grant struct {
+	source    string
+	scope     string
+	role      string
+	privilege string
+	object    string
+}
+
+// creates the audit.grants table, which lists every grant made by
+// audit_star so those removed from the config can be revoked
+func createGrantsTable(db *session) error {
+	query := `CREATE TABLE IF NOT EXISTS audit.grants(
+			source TEXT NOT NULL,
+			scope TEXT NOT NULL,
+			role NAME NOT NULL,
+			privilege TEXT NOT NULL,
+			object TEXT NOT NULL,
+			granted_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (source, scope, role, privilege, object)
+		);`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	db.log.Info("grants table created", Fields{"step": "audit_schema"})
+	return nil
+}
+
+// returns the grants of the config, along with the grantee of a table as
+// SELECT on its raw audit table and views
+func grantConfigs(opts tableOptions, c *Config) []GrantConfig {
+	grants := append([]GrantConfig(nil), c.Grants...)
+	if opts.grantee != "" {
+		grants = append(grants, GrantConfig{Role: opts.grantee, Scopes: []string{ScopeRawTables, ScopeViews}})
+	}
+	return grants
+}
+
+// returns the grants on the objects of scope, along with usage on the
+// schema holding them
+func scopeGrants(source, scope, schema string, objects []string, grants []GrantConfig) []grant {
+	var result []grant
+	for _, g := range grants {
+		if !contains(g.Scopes, scope) {
+			continue
+		}
+
+		privileges := g.Privileges
+		if len(privileges) == 0 {
+			privileges = []string{"SELECT"}
+			if scope == ScopeFunctions {
+				privileges = []string{"EXECUTE"}
+			}
+		}
+
+		result = append(result, grant{source, scope, g.Role, "USAGE", "SCHEMA " + pq.QuoteIdentifier(schema)})
+		for _, object := range objects {
+			for _, privilege := range privileges {
+				result = append(result, grant{source, scope, g.Role, strings.ToUpper(privilege), object})
+			}
+		}
+	}
+	return result
+}
+
+// grants the privileges of the config for scope on behalf of source, and
+// revokes those it granted before which the config no longer lists. a
+// privilege also granted on behalf of another source is left in place
+func applyGrants(source, scope string, desired []grant, db *session) error {
+	start := time.Now()
+	return db.inTx(func(tx *session) error {
+		rows, err := tx.Query(`SELECT role, privilege, object FROM audit.grants WHERE source = $1 AND scope = $2`, source, scope)
+		if err != nil {
+			return err
+		}
+
+		var previous []grant
+		for rows.Next() {
+			g := grant{source: source, scope: scope}
+			if err := rows.Scan(&g.role, &g.privilege, &g.object); err != nil {
+				rows.Close()
+				return err
+			}
+			previous = append(previous, g)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`DELETE FROM audit.grants WHERE source = $1 AND scope = $2`, source, scope)
+		if err != nil {
+			return err
+		}
+
+		for _, g := range desired {
+			_, err := tx.Exec(`GRANT ` + g.privilege + ` ON ` + g.object + ` TO ` + quoteRole(g.role))
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(`INSERT INTO audit.grants(source, scope, role, privilege, object)
+				VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING`, source, scope, g.role, g.privilege, g.object)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, g := range previous {
+			if hasGrant(desired, g) {
+				continue
+			}
+
+			// the privilege is kept while another source still needs it, and
+			// roles dropped since have nothing left to revoke
+			var keep bool
+			err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM audit.grants WHERE role = $1 AND privilege = $2 AND object = $3)
+				OR (lower($1) <> 'public' AND NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1))`, g.role, g.privilege, g.object).Scan(&keep)
+			if err != nil {
+				return err
+			}
+			if keep {
+				continue
+			}
+
+			_, err = tx.Exec(`REVOKE ` + g.privilege + ` ON ` + g.object + ` FROM ` + quoteRole(g.role))
+			if err != nil {
+				return err
+			}
+			db.log.Info("revoked privilege", Fields{"step": "grant", "grantee": g.role, "privilege": g.privilege, "relation": g.object})
+		}
+
+		if len(desired) > 0 {
+			db.log.Info("granted privileges", Fields{"step": "grant", "source": source, "scope": scope, "grants": len(desired), "duration": time.Since(start)})
+		}
+		return nil
+	})
+}
+
+func hasGrant(grants []grant, g grant) bool {
+	for _, other := range grants {
+		if other.role == g.role && other.privilege == g.privilege && other.object == g.object {
+			return true
+		}
+	}
+	return false
+}
+
+// quotes a role name, leaving PUBLIC as the keyword granting every role
+func quoteRole(role string) string {
+	if strings.EqualFold(role, "public") {
+		return "PUBLIC"
+	}
+	return pq.QuoteIdentifier(role)
+}
+
+// grants the roles of the config access to the raw audit table of a table
+func grantRawTable(schema, table string, opts tableOptions, c *Config, db *session) error {
+	auditSchema := schema + "_audit_raw"
+	objects := []string{"TABLE " + pq.QuoteIdentifier(auditSchema) + "." + pq.QuoteIdentifier(table+"_audit")}
+	desired := scopeGrants(schema+"."+table, ScopeRawTables, auditSchema, objects, grantConfigs(opts, c))
+
+	return applyGrants(schema+"."+table, ScopeRawTables, desired, db)
+}
+
+// grants the roles of the config access to the views of a table. views lose
+// their privileges when they are recreated, so this runs every time they are
+func grantViews(schema, table string, opts tableOptions, c *Config, db *session) error {
+	viewSchema := schema + "_audit"
+	var objects []string
+	for _, view := range []string{"_audit_delta", "_audit_snapshot", "_audit_compare"} {
+		objects = append(objects, "TABLE "+pq.QuoteIdentifier(viewSchema)+"."+pq.QuoteIdentifier(table+view))
+	}
+	desired := scopeGrants(schema+"."+table, ScopeViews, viewSchema, objects, grantConfigs(opts, c))
+
+	return applyGrants(schema+"."+table, ScopeViews, desired, db)
+}
+
+// grants the roles of the config access to the functions of the audit
+// schema, such as audit.verify_hash_chain
+func grantFunctions(c *Config, db *session) error {
+	objects := []string{"ALL FUNCTIONS IN SCHEMA audit"}
+	desired := scopeGrants("audit", ScopeFunctions, "audit", objects, c.Grants)
+
+	return applyGrants("audit", ScopeFunctions, desired, db)
+}
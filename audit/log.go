@@ -0,0 +1,194 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+// log levels, from the most verbose
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level of the given name, info when it is empty
+func ParseLevel(name string) (Level, error) {
+	if name == "" {
+		return LevelInfo, nil
+	}
+
+	for i, levelName := range levelNames {
+		if strings.ToLower(name) == levelName {
+			return Level(i), nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level %q, expected one of %s", name, strings.Join(levelNames, ", "))
+}
+
+var logFormats = []string{"text", "json"}
+
+// Fields are the structured values of a log entry, such as the schema, table
+// and step it is about and how long the step took
+type Fields map[string]interface{}
+
+// fields printed first in text logs, the rest follow in sorted order
+var leadingFields = []string{"database", "schema", "table", "step"}
+
+// Logger writes leveled log entries as text lines or JSON objects
+type Logger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	json  bool
+	level Level
+	now   func() time.Time
+}
+
+// NewLogger returns a logger writing entries of at least the given level to
+// w, formatted as text or json
+func NewLogger(w io.Writer, format string, level Level) (*Logger, error) {
+	switch format {
+	case "", "text":
+		return &Logger{w: w, level: level, now: time.Now}, nil
+	case "json":
+		return &Logger{w: w, json: true, level: level, now: time.Now}, nil
+	}
+
+	return nil, fmt.Errorf("unknown log format %q, expected one of %s", format, strings.Join(logFormats, ", "))
+}
+
+// returns the logger used unless another is given, text on stderr
+func defaultLogger() *Logger {
+	return &Logger{w: os.Stderr, level: LevelInfo, now: time.Now}
+}
+
+// Debug logs a debug entry
+func (l *Logger) Debug(msg string, fields Fields) {
+	l.log(LevelDebug, msg, fields)
+}
+
+// Info logs an info entry
+func (l *Logger) Info(msg string, fields Fields) {
+	l.log(LevelInfo, msg, fields)
+}
+
+// Warn logs a warning entry
+func (l *Logger) Warn(msg string, fields Fields) {
+	l.log(LevelWarn, msg, fields)
+}
+
+// Error logs an error entry
+func (l *Logger) Error(msg string, fields Fields) {
+	l.log(LevelError, msg, fields)
+}
+
+func (l *Logger) log(level Level, msg string, fields Fields) {
+	if level < l.level {
+		return
+	}
+	l.write(level, msg, fields)
+}
+
+// writes an entry regardless of the level of the logger
+func (l *Logger) write(level Level, msg string, fields Fields) {
+	now := l.now()
+
+	var line []byte
+	if l.json {
+		entry := map[string]interface{}{
+			"time":  now.Format(time.RFC3339Nano),
+			"level": level.String(),
+			"msg":   msg,
+		}
+		for key, value := range fields {
+			entry[key] = jsonValue(value)
+		}
+
+		var err error
+		line, err = json.Marshal(entry)
+		if err != nil {
+			line, _ = json.Marshal(map[string]string{"level": level.String(), "msg": msg, "error": err.Error()})
+		}
+	} else {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s %-5s %s", now.Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()), msg)
+		for _, key := range fieldOrder(fields) {
+			fmt.Fprintf(&b, " %s=%s", key, textValue(fields[key]))
+		}
+		line = []byte(b.String())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(line, '\n'))
+}
+
+// returns the keys of fields, the leading ones first
+func fieldOrder(fields Fields) []string {
+	var keys []string
+	for _, key := range leadingFields {
+		if _, ok := fields[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+
+	var rest []string
+	for key := range fields {
+		if !contains(leadingFields, key) {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+
+	return append(keys, rest...)
+}
+
+// durations are logged in seconds and errors as their message
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Duration:
+		return v.Seconds()
+	case error:
+		return v.Error()
+	}
+
+	return value
+}
+
+// values with spaces are quoted in text logs
+func textValue(value interface{}) string {
+	var s string
+	switch v := value.(type) {
+	case time.Duration:
+		s = v.Round(time.Millisecond).String()
+	case error:
+		s = v.Error()
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
@@ -0,0 +1,108 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// creates the audit.maintenance_log table, which records every change made
+// to an audit table under audit_star.maintenance_reason. only the no-DML
+// function, running as the owner, writes to it
+func createMaintenanceLogTable(db *session, c *Config) error {
+	query := `CREATE TABLE IF NOT EXISTS audit.maintenance_log(
+			maintenance_log_id BIGSERIAL PRIMARY KEY,
+			performed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			performed_by NAME NOT NULL,
+			session_user_name NAME NOT NULL,
+			transaction_id BIGINT NOT NULL DEFAULT txid_current(),
+			reason TEXT NOT NULL,
+			operation TEXT NOT NULL,
+			schema_name NAME NOT NULL,
+			table_name NAME NOT NULL,
+			old_row JSONB,
+			new_row JSONB
+		);
+
+		DROP TRIGGER IF EXISTS no_dml_on_audit_table ON audit.maintenance_log;
+		CREATE TRIGGER no_dml_on_audit_table
+		BEFORE UPDATE OR DELETE ON audit.maintenance_log
+		FOR EACH ROW
+		EXECUTE PROCEDURE audit.no_dml_on_audit_table();
+
+		DROP TRIGGER IF EXISTS no_truncate_on_audit ON audit.maintenance_log;
+		CREATE TRIGGER no_truncate_on_audit
+		BEFORE TRUNCATE ON audit.maintenance_log
+		FOR EACH STATEMENT
+		EXECUTE PROCEDURE audit.no_dml_on_audit_table();`
+
+	if c.MaintenanceRole != "" {
+		role := pq.QuoteIdentifier(c.MaintenanceRole)
+		query += `
+		GRANT USAGE ON SCHEMA audit TO ` + role + `;
+		REVOKE INSERT ON audit.maintenance_log FROM ` + role + `;
+		REVOKE USAGE ON SEQUENCE audit.maintenance_log_maintenance_log_id_seq FROM ` + role + `;`
+	}
+
+	err := db.inTx(func(tx *session) error {
+		_, err := tx.Exec(query)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	db.log.Info("maintenance log table created", Fields{"step": "audit_schema"})
+	return nil
+}
+
+// Maintenance runs statements which change audit tables, such as a
+// correction of a bad backfill, with audit_star.maintenance_reason set to
+// the reason for the length of the transaction. The no-DML triggers let them
+// through when the connected role is a member of maintenance_role, and
+// record who changed which rows and why in audit.maintenance_log. The
+// statements are rolled back when any of them fails.
+func (p *Provisioner) Maintenance(ctx context.Context, q Querier, reason, statements string) error {
+	db, config, err := p.session(ctx, q)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(reason) == "" {
+		return errors.New("maintenance needs a reason")
+	}
+	if config.MaintenanceRole == "" {
+		return errors.New("maintenance_role is not set")
+	}
+
+	err = maintain(db, reason, func(tx *session) error {
+		_, err := tx.Exec(statements)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	db.log.Info("maintenance finished", Fields{"database": config.DBName, "reason": reason})
+	return nil
+}
+
+// runs fn in a transaction with audit_star.maintenance_reason set to reason
+func maintain(db *session, reason string, fn func(tx *session) error) error {
+	return db.inTx(func(tx *session) error {
+		_, err := tx.Exec(`SELECT set_config('audit_star.maintenance_reason', $1, true)`, reason)
+		if err != nil {
+			return err
+		}
+
+		err = fn(tx)
+		if err != nil {
+			return err
+		}
+
+		// the rest of a caller's transaction is protected again
+		_, err = tx.Exec(`SELECT set_config('audit_star.maintenance_reason', '', true)`)
+		return err
+	})
+}
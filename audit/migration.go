@@ -0,0 +1,207 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Migration is the SQL of a migration pair: Up provisions auditing and Down
+// removes it again, keeping the raw audit tables and their history
+type Migration struct {
+	Up   string
+	Down string
+}
+
+// ForTable returns a Provisioner for a single schema.table, such as one
+// created by the same migration. The table is provisioned regardless of
+// included_tables, the exclusions and owner.
+func (p *Provisioner) ForTable(table string) (*Provisioner, error) {
+	if _, err := ParseTableName(table); err != nil {
+		return nil, err
+	}
+
+	config := p.config
+	config.IncludedTables = []string{table}
+	config.ExcludedTables = nil
+	config.ExcludedSchemas = nil
+	config.Owner = ""
+
+	return &Provisioner{config: config, logger: p.logger, table: table}, nil
+}
+
+// Render returns the statements Apply and Remove would run as a migration
+// pair. They are run in a transaction which is rolled back, so the statements
+// are exactly those the database needs while it is left unchanged. Until the
+// rollback the transaction holds the ACCESS EXCLUSIVE locks of the DDL on
+// the audited tables, and it needs the same rights as Apply, so Render only
+// runs once targetIsCopy confirms db is a copy, such as a staging database.
+func (p *Provisioner) Render(ctx context.Context, db *sql.DB, targetIsCopy bool) (*Migration, error) {
+	if !targetIsCopy {
+		return nil, errors.New("rendering runs apply and remove against the database before rolling them back, so it must be a copy")
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	up := &recorder{q: tx}
+	if _, err := p.Apply(ctx, up); err != nil {
+		return nil, err
+	}
+
+	down := &recorder{q: tx}
+	if err := p.Remove(ctx, down); err != nil {
+		return nil, err
+	}
+
+	return &Migration{Up: up.sql(), Down: down.sql()}, nil
+}
+
+// recorder runs statements in a transaction and keeps every one which
+// changes the database, leaving out the savepoints of the steps
+type recorder struct {
+	q          Querier
+	statements []string
+}
+
+func (r *recorder) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	result, err := r.q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return result, err
+	}
+
+	if !isSavepoint(query) {
+		statement, err := inlineArgs(query, args)
+		if err != nil {
+			return result, err
+		}
+		r.statements = append(r.statements, statement)
+	}
+	return result, nil
+}
+
+func (r *recorder) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return r.q.QueryContext(ctx, query, args...)
+}
+
+func (r *recorder) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return r.q.QueryRowContext(ctx, query, args...)
+}
+
+// returns the recorded statements as a SQL file
+func (r *recorder) sql() string {
+	var b strings.Builder
+	for i, statement := range r.statements {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+
+		statement = dedent(statement)
+		b.WriteString(statement)
+		if !strings.HasSuffix(statement, ";") {
+			b.WriteString(";")
+		}
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+func isSavepoint(query string) bool {
+	for _, prefix := range []string{"SAVEPOINT ", "RELEASE SAVEPOINT ", "ROLLBACK TO SAVEPOINT "} {
+		if strings.HasPrefix(query, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var placeholder = regexp.MustCompile(`\$(\d+)\b`)
+
+// replaces the $n placeholders of a statement with its arguments as SQL
+// literals, in one pass so the literals themselves are left alone
+func inlineArgs(query string, args []interface{}) (string, error) {
+	literals := make([]string, len(args))
+	for i, arg := range args {
+		literal, err := sqlLiteral(arg)
+		if err != nil {
+			return "", err
+		}
+		literals[i] = literal
+	}
+
+	return placeholder.ReplaceAllStringFunc(query, func(match string) string {
+		n, err := strconv.Atoi(match[1:])
+		if err != nil || n < 1 || n > len(literals) {
+			return match
+		}
+		return literals[n-1]
+	}), nil
+}
+
+// returns an argument as the SQL literal of the value the driver would send,
+// so nil is NULL and pq.Array is an array literal
+func sqlLiteral(arg interface{}) (string, error) {
+	value, err := driver.DefaultParameterConverter.ConvertValue(arg)
+	if err != nil {
+		return "", fmt.Errorf("cannot write argument %v as SQL: %v", arg, err)
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return "NULL", nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		return strings.ToUpper(strconv.FormatBool(v)), nil
+	case []byte:
+		return pq.QuoteLiteral(`\x` + hex.EncodeToString(v)), nil
+	case time.Time:
+		return pq.QuoteLiteral(v.Format(time.RFC3339Nano)), nil
+	case string:
+		return pq.QuoteLiteral(v), nil
+	}
+
+	return "", fmt.Errorf("cannot write argument of type %T as SQL", value)
+}
+
+// trims a statement and removes the indentation its lines share after the
+// first, which is written at the start of its line in the Go source
+func dedent(statement string) string {
+	lines := strings.Split(strings.TrimSpace(statement), "\n")
+
+	indent := -1
+	for _, line := range lines[1:] {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		width := len(line) - len(strings.TrimLeft(line, " \t"))
+		if indent == -1 || width < indent {
+			indent = width
+		}
+	}
+
+	for i := 1; i < len(lines); i++ {
+		if len(lines[i]) >= indent && indent > 0 {
+			lines[i] = lines[i][indent:]
+		} else {
+			lines[i] = strings.TrimSpace(lines[i])
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
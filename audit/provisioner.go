@@ -0,0 +1,168 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Querier runs the statements of a Provisioner. Both *sql.DB and *sql.Tx
+// satisfy it; given a *sql.Tx, everything runs inside that transaction and
+// is committed or rolled back by the caller.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Provisioner sets up, inspects and removes auditing as described by its
+// config. It holds no connection of its own, so it can be embedded in an
+// application's migration runner and shared between goroutines.
+type Provisioner struct {
+	config Config
+	logger *Logger
+	// the single table of a Provisioner returned by ForTable
+	table string
+}
+
+// NewProvisioner returns a Provisioner for a copy of the config. It logs as
+// text to stderr until SetLogger replaces its logger.
+func NewProvisioner(c Config) *Provisioner {
+	return &Provisioner{config: c, logger: defaultLogger()}
+}
+
+// SetLogger replaces the logger of the Provisioner
+func (p *Provisioner) SetLogger(l *Logger) {
+	p.logger = l
+}
+
+// returns the statements of a single call, along with a copy of the config
+// it may change, or an error when the patterns of the config are not valid
+func (p *Provisioner) session(ctx context.Context, q Querier) (*session, *Config, error) {
+	config := p.config
+	if err := checkPatterns(&config); err != nil {
+		return nil, nil, err
+	}
+	return &session{ctx: ctx, q: q, log: p.logger}, &config, nil
+}
+
+// session runs the statements of a single call of a Provisioner with its
+// context and logger
+type session struct {
+	ctx       context.Context
+	q         Querier
+	log       *Logger
+	savepoint int
+}
+
+func (s *session) Exec(query string, args ...interface{}) (sql.Result, error) {
+	s.debugQuery(query)
+	return s.q.ExecContext(s.ctx, query, args...)
+}
+
+func (s *session) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	s.debugQuery(query)
+	return s.q.QueryContext(s.ctx, query, args...)
+}
+
+func (s *session) QueryRow(query string, args ...interface{}) *sql.Row {
+	s.debugQuery(query)
+	return s.q.QueryRowContext(s.ctx, query, args...)
+}
+
+// logs every query at the debug level, or regardless of the level when
+// QUERY_DEBUG=1
+func (s *session) debugQuery(query string) {
+	if os.Getenv("QUERY_DEBUG") == "1" {
+		s.log.write(LevelDebug, "query", Fields{"query": query})
+		return
+	}
+	s.log.Debug("query", Fields{"query": query})
+}
+
+// runs fn in a transaction, or in a savepoint of the caller's transaction,
+// which is committed when fn succeeds and rolled back otherwise
+func (s *session) inTx(fn func(tx *session) error) error {
+	// a *sql.DB or *sql.Conn starts a transaction, a *sql.Tx a savepoint
+	if beginner, ok := s.q.(interface {
+		BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error)
+	}); ok {
+		tx, err := beginner.BeginTx(s.ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&session{ctx: s.ctx, q: tx, log: s.log})
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return tx.Commit()
+	}
+
+	s.savepoint++
+	savepoint := fmt.Sprintf("audit_star_%d", s.savepoint)
+	if _, err := s.Exec("SAVEPOINT " + savepoint); err != nil {
+		return err
+	}
+
+	err := fn(s)
+	if err != nil {
+		s.Exec("ROLLBACK TO SAVEPOINT " + savepoint)
+		return err
+	}
+
+	_, err = s.Exec("RELEASE SAVEPOINT " + savepoint)
+	return err
+}
+
+// the functions below keep the API which predates Provisioner, running with
+// a background context and logging as text to stderr
+
+// RunAll provisions auditing as described by the config, see
+// Provisioner.Apply
+func RunAll(db *sql.DB, config *Config) (*RunReport, error) {
+	return NewProvisioner(*config).Apply(context.Background(), db)
+}
+
+// RefreshViews rebuilds the views of stale tables, see
+// Provisioner.RefreshViews
+func RefreshViews(db *sql.DB, config *Config) error {
+	return NewProvisioner(*config).RefreshViews(context.Background(), db)
+}
+
+// ListTables returns the tables the config selects, see
+// Provisioner.ListTables
+func ListTables(db *sql.DB, config *Config) ([]TableSelection, error) {
+	return NewProvisioner(*config).ListTables(context.Background(), db)
+}
+
+// Purge deletes expired audit rows, see Provisioner.Purge
+func Purge(db *sql.DB, config *Config) error {
+	return NewProvisioner(*config).Purge(context.Background(), db)
+}
+
+// Remove drops the auditing of the selected tables, see Provisioner.Remove
+func Remove(db *sql.DB, config *Config) error {
+	return NewProvisioner(*config).Remove(context.Background(), db)
+}
+
+// Export writes the audit rows of the selected tables, see
+// Provisioner.Export
+func Export(db *sql.DB, config *Config, w io.Writer) error {
+	return NewProvisioner(*config).Export(context.Background(), db, w)
+}
+
+// Status returns the provisioning state of every table, see
+// Provisioner.Status
+func Status(db *sql.DB, config *Config) ([]TableStatus, error) {
+	return NewProvisioner(*config).Status(context.Background(), db)
+}
+
+// Plan returns the tables apply would change, see Provisioner.Plan
+func Plan(db *sql.DB, config *Config) ([]TableStatus, error) {
+	return NewProvisioner(*config).Plan(context.Background(), db)
+}
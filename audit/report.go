@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// outcomes of a table in a run report
+const (
+	OutcomeProvisioned   = "provisioned"
+	OutcomeSkippedNoPK   = "skipped-no-pk"
+	OutcomeSkippedFilter = "skipped-filter"
+	OutcomeFailed        = "failed"
+)
+
+// RunReport lists what a run of RunAll did to every table of a database
+type RunReport struct {
+	Database   string         `json:"database"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	Tables     []TableOutcome `json:"tables"`
+}
+
+// TableOutcome is the outcome of a single table, along with the rule which
+// selected or rejected it and the error it failed with
+type TableOutcome struct {
+	Schema   string        `json:"schema"`
+	Table    string        `json:"table"`
+	Outcome  string        `json:"outcome"`
+	Rule     string        `json:"rule,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"-"`
+}
+
+// MarshalJSON writes the duration in milliseconds
+func (o TableOutcome) MarshalJSON() ([]byte, error) {
+	type outcome TableOutcome
+	return json.Marshal(struct {
+		outcome
+		Duration float64 `json:"duration_ms"`
+	}{outcome(o), float64(o.Duration) / float64(time.Millisecond)})
+}
+
+// Count returns how many tables had the given outcome
+func (r *RunReport) Count(outcome string) int {
+	count := 0
+	for _, t := range r.Tables {
+		if t.Outcome == outcome {
+			count++
+		}
+	}
+
+	return count
+}
+
+// returns true if the report lists the given schema.table
+func (r *RunReport) has(table string) bool {
+	for _, t := range r.Tables {
+		if t.Schema+"."+t.Table == table {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sorts the tables by name, as they are provisioned in no particular order
+func (r *RunReport) sort() {
+	sort.SliceStable(r.Tables, func(i, j int) bool {
+		a, b := r.Tables[i], r.Tables[j]
+		if a.Schema != b.Schema {
+			return a.Schema < b.Schema
+		}
+		return a.Table < b.Table
+	})
+}
+
+// WriteReports writes the reports of a run to path as a JSON array, one
+// report per database
+func WriteReports(path string, reports []*RunReport) error {
+	if reports == nil {
+		reports = []*RunReport{}
+	}
+
+	data, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,191 @@
+package audit
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DefaultTenantSetting is the session setting holding the tenant of a change
+// when tenant_column is not set
+const DefaultTenantSetting = "audit_star.tenant"
+
+// creates the audit.tenant_members table, which lists the tenants whose audit
+// rows the members of each role may read. readers may only see their own
+// memberships, and only the owner may change them
+func createTenantMembersTable(db *session) error {
+	query := `CREATE TABLE IF NOT EXISTS audit.tenant_members(
+			role NAME NOT NULL,
+			tenant TEXT NOT NULL,
+			PRIMARY KEY (role, tenant)
+		);
+
+		DROP POLICY IF EXISTS audit_star_member ON audit.tenant_members;
+		CREATE POLICY audit_star_member ON audit.tenant_members
+		FOR SELECT
+		USING (EXISTS (SELECT 1 FROM pg_roles r WHERE r.rolname = tenant_members.role AND pg_has_role(current_user, r.oid, 'MEMBER')));
+
+		ALTER TABLE audit.tenant_members ENABLE ROW LEVEL SECURITY;
+
+		-- readers are granted access by grantTenantMembers, not every role
+		REVOKE ALL ON audit.tenant_members FROM PUBLIC;
+		REVOKE USAGE ON SCHEMA audit FROM PUBLIC;`
+
+	err := db.inTx(func(tx *session) error {
+		_, err := tx.Exec(query)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	db.log.Info("tenant members table created", Fields{"step": "audit_schema"})
+	return nil
+}
+
+// returns the expression the audit function records as the tenant of a
+// change: the tenant column of the changed row, or else the tenant setting
+// of the session making the change
+func tenantExpression(opts tableOptions) string {
+	if opts.tenantColumn != "" {
+		column := pq.QuoteLiteral(opts.tenantColumn)
+		return fmt.Sprintf("CASE WHEN TG_OP = 'DELETE' THEN to_json(OLD) ->> %[1]s WHEN TG_OP = 'TRUNCATE' THEN NULL ELSE to_json(NEW) ->> %[1]s END", column)
+	}
+
+	return fmt.Sprintf("NULLIF(current_setting(%s, true), '')", pq.QuoteLiteral(opts.tenantSetting))
+}
+
+// returns the condition an audit row of table must meet to be read: its
+// tenant is one of those audit.tenant_members lists for a role the reader is
+// a member of. roles are joined to pg_roles first, as pg_has_role fails for
+// roles dropped since
+func tenantCondition(table string) string {
+	return fmt.Sprintf(`"%s_audit".tenant IN (
+			SELECT m.tenant
+			FROM audit.tenant_members m
+			JOIN pg_roles r ON r.rolname = m.role
+			WHERE pg_has_role(current_user, r.oid, 'MEMBER')
+		)`, table)
+}
+
+// enables row level security on the audit table of a table with policies
+// limiting reads to the tenants of the reader's roles, or disables it when
+// row_security is off. the audit functions and the maintenance role may
+// still write every row, and the owner of the table is not limited at all
+func setRowSecurity(schema, table string, opts tableOptions, c *Config, db *session) error {
+	start := time.Now()
+	err := grantTenantMembers(schema, table, opts, c, db)
+	if err != nil {
+		return err
+	}
+
+	auditTable := `"` + schema + `_audit_raw"."` + table + `_audit"`
+	if !opts.rowSecurity {
+		var enabled bool
+		err := db.QueryRow(`SELECT relrowsecurity FROM pg_class WHERE oid = $1::regclass`, auditTable).Scan(&enabled)
+		if err != nil || !enabled {
+			return err
+		}
+	}
+
+	data := map[string]interface{}{
+		"auditSchema": schema + "_audit_raw",
+		"table":       table,
+		"condition":   tenantCondition(table),
+	}
+
+	query := `DROP POLICY IF EXISTS audit_star_tenant ON "{{.auditSchema}}"."{{.table}}_audit";
+		DROP POLICY IF EXISTS audit_star_insert ON "{{.auditSchema}}"."{{.table}}_audit";
+		DROP POLICY IF EXISTS audit_star_maintenance ON "{{.auditSchema}}"."{{.table}}_audit";`
+
+	if !opts.rowSecurity {
+		query += `
+		ALTER TABLE "{{.auditSchema}}"."{{.table}}_audit" DISABLE ROW LEVEL SECURITY;`
+	} else {
+		query += `
+		CREATE POLICY audit_star_tenant ON "{{.auditSchema}}"."{{.table}}_audit"
+		FOR SELECT
+		USING ({{.condition}});
+
+		CREATE POLICY audit_star_insert ON "{{.auditSchema}}"."{{.table}}_audit"
+		FOR INSERT
+		WITH CHECK (true);`
+
+		if c.MaintenanceRole != "" {
+			query += `
+
+		CREATE POLICY audit_star_maintenance ON "{{.auditSchema}}"."{{.table}}_audit"
+		TO ` + pq.QuoteIdentifier(c.MaintenanceRole) + `
+		USING (true);`
+		}
+
+		query += `
+
+		ALTER TABLE "{{.auditSchema}}"."{{.table}}_audit" ENABLE ROW LEVEL SECURITY;`
+	}
+
+	query, err = parseQuery(query, data)
+	if err != nil {
+		return err
+	}
+
+	err = db.inTx(func(tx *session) error {
+		_, err := tx.Exec(query)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if opts.rowSecurity {
+		db.log.Info("created row security policies", Fields{"schema": schema, "table": table, "step": "row_security", "duration": time.Since(start)})
+	}
+	return nil
+}
+
+// grants the roles reading the audit table and views of a table access to
+// audit.tenant_members, which their row filters look up, while row_security
+// is on for the table
+func grantTenantMembers(schema, table string, opts tableOptions, c *Config, db *session) error {
+	source := schema + "." + table
+	var desired []grant
+	if opts.rowSecurity {
+		for _, g := range grantConfigs(opts, c) {
+			if !contains(g.Scopes, ScopeRawTables) && !contains(g.Scopes, ScopeViews) {
+				continue
+			}
+			desired = append(desired,
+				grant{source, scopeTenantMembers, g.Role, "USAGE", "SCHEMA " + pq.QuoteIdentifier("audit")},
+				grant{source, scopeTenantMembers, g.Role, "SELECT", "TABLE audit.tenant_members"})
+		}
+	}
+
+	return applyGrants(source, scopeTenantMembers, desired, db)
+}
+
+// returns the WHERE clause limiting the views of a table to the tenants of
+// the reader. views read the audit table as their owner, who is not limited
+// by its policies, so they apply the same condition themselves. audit tables
+// which have no tenant yet are not limited
+func viewRowFilter(schema, table string, opts tableOptions, db *session) (string, error) {
+	if !opts.rowSecurity {
+		return "", nil
+	}
+
+	hasTenant, err := hasColumn(schema+"_audit_raw", table+"_audit", "tenant", db)
+	if err != nil || !hasTenant {
+		return "", err
+	}
+
+	return " WHERE " + tenantCondition(table), nil
+}
+
+// views which filter rows are security barriers, so functions in the
+// queries of readers cannot see the rows filtered out
+func securityBarrier(rowFilter string) string {
+	if rowFilter == "" {
+		return ""
+	}
+	return " WITH (security_barrier)"
+}
@@ -0,0 +1,174 @@
+package audit
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// TableStatus describes how far a table has been provisioned for auditing
+// and what apply would do to it
+type TableStatus struct {
+	Schema     string `json:"schema"`
+	Table      string `json:"table"`
+	Selected   bool   `json:"selected"`
+	Rule       string `json:"rule"`
+	PrimaryKey bool   `json:"primary_key"`
+	AuditTable bool   `json:"audit_table"`
+	Function   bool   `json:"function"`
+	Trigger    string `json:"trigger"`
+	Views      bool   `json:"views"`
+	StaleViews bool   `json:"stale_views"`
+	Action     string `json:"action,omitempty"`
+	Drift      bool   `json:"drift"`
+}
+
+// Status returns the provisioning state of every table audit_star considers,
+// sorted by name. Selected tables which are not provisioned as the config
+// asks are marked as drifted, with the action apply would take to fix them.
+func (p *Provisioner) Status(ctx context.Context, q Querier) ([]TableStatus, error) {
+	db, config, err := p.session(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return tableStatuses(db, config)
+}
+
+func tableStatuses(db *session, config *Config) ([]TableStatus, error) {
+	allSchemas, err := getAllSchemas(db, config)
+	if err != nil {
+		return nil, err
+	}
+
+	allTables, err := getAllTables(db, config, allSchemas)
+	if err != nil {
+		return nil, err
+	}
+
+	var staleViewsExist bool
+	err = db.QueryRow(`SELECT to_regclass('audit.stale_views') IS NOT NULL`).Scan(&staleViewsExist)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := filterTables(allTables, config)
+	names := make([]string, 0, len(tables))
+	for tbl := range tables {
+		names = append(names, tbl)
+	}
+	sortTableNames(names)
+
+	var statuses []TableStatus
+	for _, tbl := range names {
+		tableSettings := tables[tbl]
+		schemaTable := strings.SplitN(tbl, ".", 2)
+		status, err := tableStatus(schemaTable[0], schemaTable[1], staleViewsExist, db)
+		if err != nil {
+			return nil, err
+		}
+
+		status.Selected = tableSettings.enableTable
+		status.Rule = tableSettings.rule
+		if status.Selected {
+			status.Action = planAction(status, tableSettings.enableTrigger, config.ViewsOnly)
+			status.Drift = status.Action != "none" && !strings.HasPrefix(status.Action, "skip")
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// Plan returns the selected tables which apply would change
+func (p *Provisioner) Plan(ctx context.Context, q Querier) ([]TableStatus, error) {
+	statuses, err := p.Status(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	var plan []TableStatus
+	for _, status := range statuses {
+		if status.Drift {
+			plan = append(plan, status)
+		}
+	}
+
+	return plan, nil
+}
+
+// sorts schema.table names by schema, then table
+func sortTableNames(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		a, b := strings.SplitN(names[i], ".", 2), strings.SplitN(names[j], ".", 2)
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		return a[1] < b[1]
+	})
+}
+
+// looks up which of the objects apply creates exist for a table
+func tableStatus(schema, table string, staleViewsExist bool, db *session) (TableStatus, error) {
+	status := TableStatus{Schema: schema, Table: table}
+
+	var err error
+	status.PrimaryKey, err = hasValidPrimaryKey(schema, table, db)
+	if err != nil {
+		return status, err
+	}
+
+	query := `SELECT to_regclass(format('%I.%I', $1 || '_audit_raw', $2 || '_audit')) IS NOT NULL,
+			to_regprocedure(format('%I.%I()', $1 || '_audit_raw', 'audit_' || $1 || '_' || $2)) IS NOT NULL,
+			COALESCE((
+				SELECT CASE WHEN tgenabled = 'D' THEN 'disabled' ELSE 'enabled' END
+				FROM pg_trigger
+				WHERE tgrelid = format('%I.%I', $1, $2)::regclass
+				AND tgname = 'row_audit_star'
+			), 'missing'),
+			NOT EXISTS (
+				SELECT 1
+				FROM unnest(ARRAY['_audit_delta', '_audit_snapshot', '_audit_compare']) AS suffixes(suffix)
+				WHERE to_regclass(format('%I.%I', $1 || '_audit', $2 || suffixes.suffix)) IS NULL
+			)`
+	err = db.QueryRow(query, schema, table).Scan(&status.AuditTable, &status.Function, &status.Trigger, &status.Views)
+	if err != nil {
+		return status, err
+	}
+
+	if staleViewsExist {
+		query = `SELECT EXISTS (SELECT 1 FROM audit.stale_views WHERE schema_name = $1 AND table_name = $2)`
+		err = db.QueryRow(query, schema, table).Scan(&status.StaleViews)
+		if err != nil {
+			return status, err
+		}
+	}
+
+	return status, nil
+}
+
+// returns what apply would do to a selected table in the given state
+func planAction(status TableStatus, enableTrigger, viewsOnly bool) string {
+	switch {
+	case !status.PrimaryKey:
+		return "skip: no single-column primary key"
+	case viewsOnly && !status.Views:
+		return "create views"
+	case viewsOnly && status.StaleViews:
+		return "refresh views"
+	case viewsOnly:
+		return "none"
+	case !status.AuditTable && !status.Function && status.Trigger == "missing":
+		return "provision"
+	case !status.AuditTable || !status.Function || status.Trigger == "missing" || !status.Views:
+		return "repair"
+	case enableTrigger && status.Trigger == "disabled":
+		return "enable trigger"
+	case !enableTrigger && status.Trigger == "enabled":
+		return "disable trigger"
+	case status.StaleViews:
+		return "refresh views"
+	}
+
+	return "none"
+}
@@ -47,16 +47,13 @@ func setupDB(c *Config) *sql.DB {
 // runallTest ...
 func runAllTest() {
 	var c Config
-	// ParseFlags parses command-line flags
-	// note: even though the tests are not using command-line flags, ParseFlags
-	// does set some default values, such as the path to the config file
-	ParseFlags(&c)
+	c.CfgPath = DefaultConfigPath
 	getConfig(&c)
 
 	db := setupDB(&c)
 	defer db.Close()
 
-	err := RunAll(db, &c)
+	_, err := RunAll(db, &c)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
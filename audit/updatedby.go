@@ -0,0 +1,117 @@
+package audit
+
+import (
+	"fmt"
+	"time"
+)
+
+// UpdatedByConfig holds the settings of the column recording who last changed
+// each row of an audited table
+type UpdatedByConfig struct {
+	Column    string `yaml:"column"`
+	Type      string `yaml:"type"`
+	AddColumn *bool  `yaml:"add_column"`
+	Trigger   bool   `yaml:"trigger"`
+}
+
+// returns the name and type of the updated_by column, and whether it is
+// added to the audited tables
+func (u UpdatedByConfig) column() (string, string, bool) {
+	column, colType := "updated_by", "varchar(50)"
+	if u.Column != "" {
+		column = u.Column
+	}
+	if u.Type != "" {
+		colType = u.Type
+	}
+
+	return column, colType, u.AddColumn == nil || *u.AddColumn
+}
+
+// adds the updated_by column to a table unless add_column is off
+func addUpdatedByColumn(schema, table string, c *Config, db *session) error {
+	column, colType, add := c.UpdatedBy.column()
+	if !add {
+		return nil
+	}
+
+	return addColToTable(schema, table, column, colType, db)
+}
+
+// creates the trigger which sets the updated_by column of a table to the
+// actor of every insert and update, or drops it when the trigger setting is
+// off. rows changed without an actor keep the value they were given, as do
+// updates which change nothing else, so skip_noop_updates still sees them
+// as no-ops
+func setUpdatedByTrigger(schema, table string, c *Config, db *session) error {
+	start := time.Now()
+	column, _, _ := c.UpdatedBy.column()
+	data := map[string]interface{}{
+		"schema":    schema,
+		"table":     table,
+		"column":    column,
+		"changedBy": changedByExpression(c),
+		"security":  tableOptionsFor(schema, table, c).security,
+	}
+
+	query := `DROP TRIGGER IF EXISTS updated_by_audit_star ON "{{.schema}}"."{{.table}}";`
+	if c.UpdatedBy.Trigger {
+		exists, err := hasColumn(schema, table, column, db)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%s.%s has no %s column for the updated_by trigger", schema, table, column)
+		}
+
+		query = `CREATE OR REPLACE FUNCTION "{{.schema}}_audit_raw"."updated_by_{{.schema}}_{{.table}}"()
+			RETURNS TRIGGER AS
+			$$
+			DECLARE
+				actor TEXT = NULLIF({{.changedBy}}, '');
+				given TEXT;
+			BEGIN
+				IF TG_OP = 'UPDATE' THEN
+					-- rows are compared as json, as not every type has equality
+					given = NEW."{{.column}}";
+					NEW."{{.column}}" = OLD."{{.column}}";
+					IF row_to_json(NEW)::TEXT = row_to_json(OLD)::TEXT THEN
+						actor = NULL;
+					END IF;
+					NEW."{{.column}}" = given;
+				END IF;
+
+				IF actor IS NOT NULL THEN
+					NEW."{{.column}}" = actor;
+				END IF;
+				RETURN NEW;
+			END;
+			$$
+			LANGUAGE plpgsql
+			SECURITY {{.security}};
+
+			` + query + `
+			CREATE TRIGGER updated_by_audit_star
+			BEFORE INSERT OR UPDATE ON "{{.schema}}"."{{.table}}"
+			FOR EACH ROW
+			EXECUTE PROCEDURE "{{.schema}}_audit_raw"."updated_by_{{.schema}}_{{.table}}"();`
+	}
+
+	query, err := parseQuery(query, data)
+	if err != nil {
+		return err
+	}
+
+	err = db.inTx(func(tx *session) error {
+		_, err := tx.Exec(query)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.UpdatedBy.Trigger {
+		db.log.Info("created updated_by trigger", Fields{"schema": schema, "table": table, "step": "updated_by", "column": column, "duration": time.Since(start)})
+	}
+	return nil
+}
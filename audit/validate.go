@@ -0,0 +1,316 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// ConfigError is a problem with a single setting of the config. Line is the
+// line of the setting in the config file, or 0 when it was set by a flag.
+type ConfigError struct {
+	Line    int    `json:"line,omitempty"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e ConfigError) Error() string {
+	msg := e.Message
+	if e.Field != "" {
+		msg = e.Field + ": " + msg
+	}
+	if e.Line > 0 {
+		msg = fmt.Sprintf("line %d: %s", e.Line, msg)
+	}
+
+	return msg
+}
+
+// ConfigErrors lists every problem found in the config
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, problem := range e {
+		msgs[i] = problem.Error()
+	}
+
+	return "invalid config:\n  " + strings.Join(msgs, "\n  ")
+}
+
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+var securityModes = []string{"definer", "invoker"}
+var payloadEngines = []string{"hstore", "jsonb"}
+var triggerModes = []string{"enabled", "disabled"}
+
+// postgres durations such as 500, 5s or 1min
+var durationSyntax = regexp.MustCompile(`^\d+\s*(us|ms|s|min|h|d)?$`)
+
+// postgres intervals such as 90 days or 1 year 6 months, or ISO 8601 ones
+// such as P1Y6M
+var intervalSyntax = regexp.MustCompile(`(?i)^((\d+\s*[a-z]+\s*)+|P[0-9YMWD]*(T[0-9HMS.]+)?)$`)
+
+// custom settings are named by a prefix and a name, like audit_star.tenant
+var settingSyntax = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*\.[A-Za-z_][A-Za-z0-9_$]*$`)
+
+// actors may also come from built-in settings, like application_name
+var actorSettingSyntax = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*(\.[A-Za-z_][A-Za-z0-9_$]*)?$`)
+
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// Validate checks every setting of the config, returning ConfigErrors listing
+// all the problems found, ordered by line
+func Validate(c *Config) error {
+	v := validator{lines: c.lines}
+
+	v.oneOf("ssl_mode", c.SSLMode, sslModes)
+	v.oneOf("security", strings.ToLower(c.Security), securityModes)
+	v.oneOf("payload_engine", c.PayloadEngine, payloadEngines)
+	v.oneOf("log_format", c.LogFormat, logFormats)
+	v.oneOf("log_level", strings.ToLower(c.LogLevel), levelNames)
+
+	if c.Port != "" {
+		port, err := strconv.Atoi(c.Port)
+		if err != nil || port < 1 || port > 65535 {
+			v.add("port", "%q is not a port number", c.Port)
+		}
+	}
+
+	if c.LockTimeout != "" && !durationSyntax.MatchString(c.LockTimeout) {
+		v.add("lock_timeout", "%q is not a duration like 500ms, 5s or 1min", c.LockTimeout)
+	}
+
+	if isDatabasePattern(c.DBName) {
+		v.pattern("db_name", c.DBName)
+	}
+
+	v.length("parallelism", c.Parallelism)
+	v.interval("retention", c.Retention)
+	v.length("value_max_length", c.ValueMaxLength)
+	v.length("query_max_length", c.QueryMaxLength)
+
+	if c.TenantSetting != "" && !settingSyntax.MatchString(c.TenantSetting) {
+		v.add("tenant_setting", "%q is not a setting name like audit_star.tenant", c.TenantSetting)
+	}
+
+	for i, pattern := range c.IncludedTables {
+		v.tablePattern(fmt.Sprintf("included_tables[%d]", i), pattern)
+	}
+	for i, pattern := range c.ExcludedTables {
+		v.tablePattern(fmt.Sprintf("excluded_tables[%d]", i), pattern)
+	}
+	for i, pattern := range c.ExcludedSchemas {
+		v.pattern(fmt.Sprintf("excluded_schemas[%d]", i), pattern)
+	}
+
+	for i, source := range c.ActorSources {
+		field := fmt.Sprintf("actor_sources[%d]", i)
+		if !actorSettingSyntax.MatchString(source.Setting) {
+			v.add(field+".setting", "%q is not a setting name like request.jwt.claims", source.Setting)
+		}
+		if source.Path != "" && contains(strings.Split(source.Path, "."), "") {
+			v.add(field+".path", "%q is not a path like app_metadata.user_id", source.Path)
+		}
+	}
+
+	for i, g := range c.Grants {
+		field := fmt.Sprintf("grants[%d]", i)
+		if g.Role == "" {
+			v.add(field+".role", "must name a role")
+		}
+		if len(g.Scopes) == 0 {
+			v.add(field+".scopes", "must list at least one of %s", strings.Join(grantScopes, ", "))
+		}
+		for _, scope := range g.Scopes {
+			v.oneOf(field+".scopes", scope, grantScopes)
+		}
+		for _, privilege := range g.Privileges {
+			privilege = strings.ToUpper(privilege)
+			v.oneOf(field+".privileges", privilege, append(append([]string{}, tablePrivileges...), functionPrivileges...))
+			if contains(functionPrivileges, privilege) && (contains(g.Scopes, ScopeRawTables) || contains(g.Scopes, ScopeViews)) {
+				v.add(field+".privileges", "%s only applies to functions", privilege)
+			}
+			if contains(tablePrivileges, privilege) && contains(g.Scopes, ScopeFunctions) {
+				v.add(field+".privileges", "%s does not apply to functions", privilege)
+			}
+		}
+	}
+
+	for key, tc := range c.Tables {
+		field := "tables[" + key + "]"
+		v.tablePattern(field, key)
+		v.oneOf(field+".security", strings.ToLower(tc.Security), securityModes)
+		v.oneOf(field+".trigger", tc.Trigger, triggerModes)
+		v.interval(field+".retention", tc.Retention)
+		v.length(field+".value_max_length", tc.ValueMaxLength)
+		v.length(field+".query_max_length", tc.QueryMaxLength)
+	}
+
+	return v.err()
+}
+
+// Append returns the problems of e and err, which may be ConfigErrors, sorted
+// by line. Other errors are returned unchanged.
+func (e ConfigErrors) Append(err error) error {
+	if err == nil {
+		if len(e) == 0 {
+			return nil
+		}
+		return e
+	}
+
+	problems, ok := err.(ConfigErrors)
+	if !ok {
+		return err
+	}
+
+	v := validator{problems: append(append(ConfigErrors{}, e...), problems...)}
+	return v.err()
+}
+
+// collects the problems of a config along with their lines
+type validator struct {
+	lines    map[string]int
+	problems ConfigErrors
+}
+
+func (v *validator) add(field, format string, args ...interface{}) {
+	v.problems = append(v.problems, ConfigError{
+		Line:    v.lines[field],
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// checks that a setting is empty or one of the allowed values
+func (v *validator) oneOf(field, value string, allowed []string) {
+	if value == "" {
+		return
+	}
+
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+
+	v.add(field, "unknown value %q, expected one of %s", value, strings.Join(allowed, ", "))
+}
+
+func (v *validator) interval(field, value string) {
+	if value != "" && !intervalSyntax.MatchString(value) {
+		v.add(field, "%q is not an interval like 90 days", value)
+	}
+}
+
+func (v *validator) length(field string, value int) {
+	if value < 0 {
+		v.add(field, "must not be negative")
+	}
+}
+
+// checks a schema pattern, or any re: pattern
+func (v *validator) pattern(field, pattern string) {
+	if strings.HasPrefix(pattern, "re:") {
+		if _, err := regexp.Compile(strings.TrimPrefix(pattern, "re:")); err != nil {
+			v.add(field, "invalid regular expression: %v", err)
+		}
+		return
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		v.add(field, "invalid pattern %q", pattern)
+	}
+}
+
+// checks a table pattern, which must name a schema and a table unless it
+// is a regular expression
+func (v *validator) tablePattern(field, pattern string) {
+	before := len(v.problems)
+	v.pattern(field, pattern)
+	if len(v.problems) > before || strings.HasPrefix(pattern, "re:") {
+		return
+	}
+
+	if _, err := ParseTableName(pattern); err != nil {
+		v.add(field, "%q: %v", pattern, err)
+	}
+}
+
+// returns the problems sorted by line, flag problems last, or nil
+func (v *validator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		a, b := v.problems[i].Line, v.problems[j].Line
+		if a == 0 || b == 0 {
+			return b == 0 && a != 0
+		}
+		return a < b
+	})
+
+	return v.problems
+}
+
+// records the line of every setting of a parsed config file, keyed by the
+// field names Validate reports
+func recordLines(node *yaml.Node, field string, lines map[string]int) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			recordLines(child, field, lines)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			keyField := key.Value
+			if field == "tables" {
+				keyField = "tables[" + key.Value + "]"
+			} else if field != "" {
+				keyField = field + "." + key.Value
+			}
+
+			lines[keyField] = key.Line
+			recordLines(value, keyField, lines)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			itemField := fmt.Sprintf("%s[%d]", field, i)
+			lines[itemField] = item.Line
+			recordLines(item, itemField, lines)
+		}
+	}
+}
+
+// turns the errors of the yaml decoder into ConfigErrors, or returns them
+// unchanged when they carry no line
+func decodeErrors(err error) error {
+	var messages []string
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	} else {
+		messages = []string{err.Error()}
+	}
+
+	var problems ConfigErrors
+	for _, message := range messages {
+		match := yamlErrorLine.FindStringSubmatch(message)
+		if match == nil {
+			return err
+		}
+
+		line, _ := strconv.Atoi(match[1])
+		problems = append(problems, ConfigError{Line: line, Message: match[2]})
+	}
+
+	return problems
+}
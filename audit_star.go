@@ -1,38 +1,828 @@
 package main
 
 import (
-	"log"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
 	"github.com/enova/audit_star/audit"
 )
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+var output = flag.String("output", "text", "Output format of the command results, text or json.")
+var outDir = flag.String("out", "db/migrate", "Directory generate writes its migration files to.")
+var targetIsCopy = flag.Bool("target-is-copy", false, "Confirm the database generate connects to is a copy, as it runs apply and remove there, holding their locks until it rolls them back.")
+var reason = flag.String("reason", "", "Reason maintenance and erase record for their changes.")
+var maintenanceSQL = flag.String("sql", "", "Statements maintenance runs.")
+var maintenanceFile = flag.String("sql-file", "", "File holding the statements maintenance runs, - for stdin.")
+var sinceCheckpoint = flag.Bool("since-checkpoint", false, "Make verify also check the audit tables against the signed checkpoints of checkpoint_file.")
+
+// true when the command runs against the databases section of the config
+var multipleDatabases bool
+
+// logs to stderr as text until the config sets the log format and level
+var logger, _ = audit.NewLogger(os.Stderr, "text", audit.LevelInfo)
+
+// exit codes shared by every command
+const (
+	exitOK    = 0
+	exitError = 1
+	exitDrift = 2
+)
+
+// the outcome of a command against one database. drift is true when the
+// command found drift or only partially succeeded
+type result struct {
+	value  interface{}
+	text   func(w io.Writer)
+	drift  bool
+	report *audit.RunReport
+}
+
+// a subcommand of audit_star
+type command struct {
+	usage   string
+	connect bool
+	run     func(ctx context.Context, db *sql.DB, c *audit.Config) (result, error)
+}
+
+var commands = map[string]command{
+	"apply":         {"set up auditing on the tables selected by the config (default)", true, apply},
+	"maintenance":   {"run statements changing audit tables as maintenance_role, recording why in audit.maintenance_log", true, maintenance},
+	"plan":          {"print what apply would change without changing anything", true, plan},
+	"status":        {"print how far every table is provisioned for auditing", true, status},
+	"remove":        {"drop the triggers, functions and views of the selected tables, keeping their history", true, remove},
+	"refresh-views": {"rebuild the views of tables altered since they were provisioned", true, refreshViews},
+	"checkpoint":    {"record the state of the audit tables in audit.checkpoints and the signed checkpoint file", true, checkpoint},
+	"erase":         {"redact the personal_columns of the row -pk of each -table from its audit history", true, erase},
+	"export":        {"write the audit rows of the selected tables as JSON lines", true, export},
+	"generate":      {"write what apply would run and a down migration undoing it as migration files", true, generate},
+	"verify":        {"check that every selected table is provisioned as configured and its hash chain is intact", true, verify},
+	"list-tables":   {"print which tables the config selects and why", true, listTables},
+	"purge":         {"delete audit rows older than the configured retention", true, purge},
+	"version":       {"print the version of audit_star", false, printVersion},
+	// validate-config is run by main itself, as it must report the config
+	// problems every other command stops at
+	"validate-config": {"check the config file and flags without connecting", false, nil},
+}
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [command] [flags]\n\ncommands:\n", os.Args[0])
+
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		w := tabwriter.NewWriter(flag.CommandLine.Output(), 0, 4, 2, ' ', 0)
+		for _, name := range names {
+			fmt.Fprintf(w, "  %s\t%s\n", name, commands[name].usage)
+		}
+		w.Flush()
+
+		fmt.Fprintf(flag.CommandLine.Output(), "\nflags:\n")
+		flag.PrintDefaults()
+	}
+}
+
 // error checker helper function
 func checkErr(err error) {
 	if err != nil {
-		log.Fatalf("ERROR: %+v\n", err)
+		if *output == "json" {
+			json.NewEncoder(os.Stdout).Encode(map[string]string{"error": err.Error()})
+		}
+		logger.Error(err.Error(), nil)
+		os.Exit(exitError)
 	}
 }
 
 func main() {
 	var c audit.Config
 
+	// the command comes first, but is still accepted after the flags
+	name := ""
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		name = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	// parse command-line flags
-	err := audit.ParseFlags(&c)
+	parseFlags(&c)
+
+	if name == "" {
+		name = flag.Arg(0)
+	}
+	if name == "" {
+		name = "apply"
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		checkErr(fmt.Errorf("unknown command %q", name))
+	}
+	if *output != "text" && *output != "json" {
+		checkErr(fmt.Errorf("unknown output %q, expected text or json", *output))
+	}
+
+	if name == "validate-config" {
+		os.Exit(validateConfig(&c))
+	}
+
+	if !cmd.connect {
+		res, err := cmd.run(context.Background(), nil, &c)
+		checkErr(err)
+		checkErr(printResult(res.value, res.text))
+		os.Exit(exitOK)
+	}
+
+	configs, err := loadConfigs(&c)
 	checkErr(err)
+	checkErr(setLogger(&c))
+
+	// an interrupt cancels the statements running at the time
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// a single database keeps the plain output of the command
+	if len(c.Databases) == 0 {
+		res, err := runCommand(ctx, cmd, &configs[0])
+		checkErr(writeReport(&c, res.report))
+		checkErr(err)
+		checkErr(printResult(res.value, res.text))
 
-	// read config from file
-	err = audit.GetConfig(&c)
+		if res.drift {
+			os.Exit(exitDrift)
+		}
+		os.Exit(exitOK)
+	}
+
+	configs, err = audit.ExpandDatabases(configs)
 	checkErr(err)
+	multipleDatabases = true
+
+	results := runDatabases(ctx, cmd, configs, c.Parallelism)
+	var reports []*audit.RunReport
+	for _, res := range results {
+		if res.report != nil {
+			reports = append(reports, res.report)
+		}
+	}
+	checkErr(writeReport(&c, reports...))
+	checkErr(printDatabaseResults(results))
+	os.Exit(databasesExitCode(results))
+}
+
+// reads the config file and overrides it with the flags, returning the
+// config of every database it lists once all of them have been checked.
+// a -db_name flag runs against that database alone, with the top-level
+// settings
+func loadConfigs(c *audit.Config) ([]audit.Config, error) {
+	// read config from file, keeping going on unknown keys so that every
+	// problem is reported at once
+	err := audit.GetConfig(c)
+	problems, ok := err.(audit.ConfigErrors)
+	if err != nil && !ok {
+		return nil, err
+	}
+
+	configs := []audit.Config{*c}
+	if !isFlagSet("db_name") {
+		var entryErr error
+		configs, entryErr = audit.DatabaseConfigs(c)
+		if entryErr != nil {
+			entryProblems, ok := entryErr.(audit.ConfigErrors)
+			if !ok {
+				return nil, entryErr
+			}
+			problems = append(problems, entryProblems...)
+		}
+	} else {
+		c.Databases = nil
+	}
 
 	// override config file values with CLI flag values if specified
-	err = audit.ParseCLIOverrides(&c)
-	checkErr(err)
+	err = parseCLIOverrides(c)
+	if err != nil {
+		return nil, err
+	}
+	for i := range configs {
+		err = parseCLIOverrides(&configs[i])
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	// connect to the DB
-	db, err := audit.DBOpen(&c)
-	checkErr(err)
+	// every database is checked, as entries may override any setting, but
+	// problems of the shared settings are only reported once
+	if len(c.Databases) == 0 {
+		err = problems.Append(audit.Validate(c))
+	} else {
+		seen := map[string]bool{}
+		for _, problem := range problems {
+			seen[problem.Error()] = true
+		}
+		for i := range configs {
+			dbProblems, _ := audit.Validate(&configs[i]).(audit.ConfigErrors)
+			for _, problem := range dbProblems {
+				if !seen[problem.Error()] {
+					seen[problem.Error()] = true
+					problems = append(problems, problem)
+				}
+			}
+		}
+		err = audit.ConfigErrors{}.Append(problems)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return configs, nil
+}
 
-	// set up auditing on tables not excluded in the config
-	err = audit.RunAll(db, &c)
+// logs in the format and from the level of the config
+func setLogger(c *audit.Config) error {
+	level, err := audit.ParseLevel(c.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	logger, err = audit.NewLogger(os.Stderr, c.LogFormat, level)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// writes the reports of apply to the report file of the config, if any
+func writeReport(c *audit.Config, reports ...*audit.RunReport) error {
+	if c.Report == "" || len(reports) == 0 || reports[0] == nil {
+		return nil
+	}
+
+	return audit.WriteReports(c.Report, reports)
+}
+
+// prints every problem of the config and returns the exit code
+func validateConfig(c *audit.Config) int {
+	problems := audit.ConfigErrors{}
+	_, err := loadConfigs(c)
+	if err != nil {
+		configErrors, ok := err.(audit.ConfigErrors)
+		if !ok {
+			checkErr(err)
+		}
+		problems = configErrors
+	}
+
+	err = printResult(problems, func(w io.Writer) {
+		if len(problems) == 0 {
+			fmt.Fprintln(w, "config is valid")
+		}
+		for _, problem := range problems {
+			fmt.Fprintln(w, problem.Error())
+		}
+	})
 	checkErr(err)
+
+	if len(problems) > 0 {
+		return exitError
+	}
+	return exitOK
+}
+
+// connects to the database of the config and runs the command against it
+func runCommand(ctx context.Context, cmd command, c *audit.Config) (result, error) {
+	db, err := audit.DBOpen(c)
+	if err != nil {
+		return result{}, err
+	}
+	defer db.Close()
+	logger.Info("successfully connected", audit.Fields{"database": c.DBName})
+
+	return cmd.run(ctx, db, c)
+}
+
+// returns a provisioner for the config which logs to the logger of the run
+func provisioner(c *audit.Config) *audit.Provisioner {
+	p := audit.NewProvisioner(*c)
+	p.SetLogger(logger)
+	return p
+}
+
+// the outcome of a command against one of several databases
+type databaseResult struct {
+	Database string      `json:"database"`
+	Status   string      `json:"status"`
+	Error    string      `json:"error,omitempty"`
+	Result   interface{} `json:"result,omitempty"`
+
+	text   func(w io.Writer)
+	report *audit.RunReport
+}
+
+// runs the command against every database, at most parallelism at a time
+func runDatabases(ctx context.Context, cmd command, configs []audit.Config, parallelism int) []databaseResult {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	results := make([]databaseResult, len(configs))
+	slots := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i := range configs {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			c := configs[i]
+			logger.Info("running against database", audit.Fields{"database": c.DBName})
+			res, err := runCommand(ctx, cmd, &c)
+
+			results[i] = databaseResult{Database: c.DBName, Status: "ok", Result: res.value, text: res.text, report: res.report}
+			switch {
+			case err != nil:
+				results[i].Status = "failed"
+				results[i].Error = err.Error()
+				logger.Error("failed to run against database", audit.Fields{"database": c.DBName, "error": err})
+			case res.drift:
+				results[i].Status = "drift"
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// prints the result of every database followed by a summary of them
+func printDatabaseResults(results []databaseResult) error {
+	if *output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(map[string]interface{}{"databases": results})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, res := range results {
+		if res.text != nil {
+			fmt.Fprintf(w, "== %s ==\n", res.Database)
+			res.text(w)
+			fmt.Fprintln(w)
+		}
+	}
+
+	fmt.Fprintln(w, "DATABASE\tSTATUS\tERROR")
+	for _, res := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", res.Database, res.Status, res.Error)
+	}
+
+	return w.Flush()
+}
+
+// returns 1 when every database failed, 2 when some failed or drifted
+func databasesExitCode(results []databaseResult) int {
+	failed, drifted := 0, 0
+	for _, res := range results {
+		switch res.Status {
+		case "failed":
+			failed++
+		case "drift":
+			drifted++
+		}
+	}
+
+	switch {
+	case failed == len(results):
+		return exitError
+	case failed > 0 || drifted > 0:
+		return exitDrift
+	}
+	return exitOK
+}
+
+// prints v as JSON when -output json is given, otherwise lets text print it
+func printResult(v interface{}, text func(w io.Writer)) error {
+	if text == nil {
+		return nil
+	}
+	if *output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(v)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	text(w)
+	return w.Flush()
+}
+
+// the outcome of a command which changes the database. with
+// continue_on_error, tables which failed leave the command partially
+// successful instead of failing it
+func runResult(name string, c *audit.Config, err error) (result, error) {
+	failed := []*audit.TableError{}
+	var runErr *audit.RunError
+	if errors.As(err, &runErr) && c.ContinueOnError {
+		failed = runErr.Tables
+	} else if err != nil {
+		return result{}, err
+	}
+
+	return result{
+		value: map[string]interface{}{"command": name, "failed": failed},
+		text: func(w io.Writer) {
+			fmt.Fprintf(w, "%s finished with %d errors\n", name, len(failed))
+			for _, tableErr := range failed {
+				fmt.Fprintf(w, "%s.%s\t%v\n", tableErr.Schema, tableErr.Table, tableErr.Err)
+			}
+		},
+		drift: len(failed) > 0,
+	}, nil
+}
+
+// sets up auditing on tables not excluded in the config
+func apply(ctx context.Context, db *sql.DB, c *audit.Config) (result, error) {
+	report, err := provisioner(c).Apply(ctx, db)
+	var runErr *audit.RunError
+	if err != nil && !(errors.As(err, &runErr) && c.ContinueOnError) {
+		return result{report: report}, err
+	}
+
+	failed := report.Count(audit.OutcomeFailed)
+	return result{
+		value: report,
+		text: func(w io.Writer) {
+			fmt.Fprintf(w, "apply finished with %d errors\n", failed)
+			for _, t := range report.Tables {
+				if t.Outcome == audit.OutcomeFailed {
+					fmt.Fprintf(w, "%s.%s\t%s\n", t.Schema, t.Table, t.Error)
+				}
+			}
+		},
+		drift:  failed > 0,
+		report: report,
+	}, nil
+}
+
+// prints the changes apply would make
+func plan(ctx context.Context, db *sql.DB, c *audit.Config) (result, error) {
+	changes, err := provisioner(c).Plan(ctx, db)
+	if err != nil {
+		return result{}, err
+	}
+
+	return result{
+		value: changes,
+		text: func(w io.Writer) {
+			if len(changes) == 0 {
+				fmt.Fprintln(w, "no changes")
+			}
+			for _, change := range changes {
+				fmt.Fprintf(w, "%s.%s\t%s\n", change.Schema, change.Table, change.Action)
+			}
+		},
+		drift: len(changes) > 0,
+	}, nil
+}
+
+// prints the provisioning state of every table
+func status(ctx context.Context, db *sql.DB, c *audit.Config) (result, error) {
+	statuses, err := provisioner(c).Status(ctx, db)
+	if err != nil {
+		return result{}, err
+	}
+
+	drift := false
+	for _, s := range statuses {
+		drift = drift || s.Drift
+	}
+
+	return result{
+		value: statuses,
+		text: func(w io.Writer) {
+			fmt.Fprintln(w, "TABLE\tSELECTED\tAUDIT TABLE\tTRIGGER\tVIEWS\tACTION")
+			for _, s := range statuses {
+				views := fmt.Sprint(s.Views)
+				if s.StaleViews {
+					views = "stale"
+				}
+				fmt.Fprintf(w, "%s.%s\t%v\t%v\t%s\t%s\t%s\n", s.Schema, s.Table, s.Selected, s.AuditTable, s.Trigger, views, s.Action)
+			}
+		},
+		drift: drift,
+	}, nil
+}
+
+// drops the auditing objects of the selected tables
+func remove(ctx context.Context, db *sql.DB, c *audit.Config) (result, error) {
+	return runResult("remove", c, provisioner(c).Remove(ctx, db))
+}
+
+// rebuilds the views of tables altered since they were provisioned
+func refreshViews(ctx context.Context, db *sql.DB, c *audit.Config) (result, error) {
+	return runResult("refresh-views", c, provisioner(c).RefreshViews(ctx, db))
+}
+
+// writes the statements apply would run to a timestamped pair of migration
+// files named like pgmgr's, in a directory per database when there are
+// several. it only runs against a database confirmed to be a copy, as
+// rendering locks its tables
+func generate(ctx context.Context, db *sql.DB, c *audit.Config) (result, error) {
+	if !*targetIsCopy {
+		return result{}, errors.New("generate runs apply and remove against the database it connects to, confirm it is a copy with -target-is-copy")
+	}
+
+	migration, err := provisioner(c).Render(ctx, db, *targetIsCopy)
+	if err != nil {
+		return result{}, err
+	}
+
+	dir := *outDir
+	if multipleDatabases {
+		dir = filepath.Join(dir, c.DBName)
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return result{}, err
+	}
+
+	header := fmt.Sprintf("-- generated by audit_star %s for database %s\n\n", version, c.DBName)
+	name := filepath.Join(dir, fmt.Sprintf("%d_audit_star", time.Now().Unix()))
+	files := map[string]string{"up": name + ".up.sql", "down": name + ".down.sql"}
+
+	err = ioutil.WriteFile(files["up"], []byte(header+migration.Up), 0644)
+	if err != nil {
+		return result{}, err
+	}
+	err = ioutil.WriteFile(files["down"], []byte(header+migration.Down), 0644)
+	if err != nil {
+		return result{}, err
+	}
+
+	return result{
+		value: files,
+		text: func(w io.Writer) {
+			fmt.Fprintln(w, files["up"])
+			fmt.Fprintln(w, files["down"])
+		},
+	}, nil
+}
+
+// writes the audit rows of the selected tables, always as JSON lines
+func export(ctx context.Context, db *sql.DB, c *audit.Config) (result, error) {
+	return result{}, provisioner(c).Export(ctx, db, stdout)
+}
+
+// stdout is shared by the databases exported at once, so that their lines
+// are not interleaved
+var stdout = &lockedWriter{w: os.Stdout}
+
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// prints the selected tables which are not provisioned as configured, and
+// the first broken link of every hash chain which does not verify
+func verify(ctx context.Context, db *sql.DB, c *audit.Config) (result, error) {
+	p := provisioner(c)
+	statuses, err := p.Status(ctx, db)
+	if err != nil {
+		return result{}, err
+	}
+
+	problems := []audit.TableStatus{}
+	for _, s := range statuses {
+		if s.Drift {
+			problems = append(problems, s)
+		}
+	}
+
+	chains, err := p.VerifyChains(ctx, db)
+	if err != nil {
+		return result{}, err
+	}
+
+	broken := 0
+	for _, chain := range chains {
+		if !chain.Valid {
+			broken++
+		}
+	}
+
+	value := map[string]interface{}{"tables": problems, "chains": chains}
+	checkpoints := []audit.CheckpointStatus{}
+	if *sinceCheckpoint {
+		checkpoints, err = p.VerifyCheckpoints(ctx, db)
+		if err != nil {
+			return result{}, err
+		}
+		value["checkpoints"] = checkpoints
+	}
+	for _, cp := range checkpoints {
+		if !cp.Valid {
+			broken++
+		}
+	}
+
+	return result{
+		value: value,
+		text: func(w io.Writer) {
+			if len(problems) == 0 {
+				fmt.Fprintf(w, "verified %d tables\n", len(statuses))
+			}
+			for _, s := range problems {
+				fmt.Fprintf(w, "%s.%s\tnot provisioned as configured, apply would %s\n", s.Schema, s.Table, s.Action)
+			}
+			for _, chain := range chains {
+				switch {
+				case chain.Valid:
+					fmt.Fprintf(w, "%s.%s\thash chain verified, %d rows\n", chain.Schema, chain.Table, chain.Rows)
+				case chain.BrokenAt != 0:
+					fmt.Fprintf(w, "%s.%s\thash chain broken at chain_seq %d: %s\n", chain.Schema, chain.Table, chain.BrokenAt, chain.Problem)
+				default:
+					fmt.Fprintf(w, "%s.%s\t%s\n", chain.Schema, chain.Table, chain.Problem)
+				}
+			}
+			verified := 0
+			for _, cp := range checkpoints {
+				if cp.Valid {
+					verified++
+					continue
+				}
+				fmt.Fprintf(w, "%s.%s\tcheckpoint %d: %s\n", cp.Schema, cp.Table, cp.Checkpoint, cp.Problem)
+			}
+			if *sinceCheckpoint {
+				fmt.Fprintf(w, "verified %d of %d checkpointed tables\n", verified, len(checkpoints))
+			}
+		},
+		drift: len(problems) > 0 || broken > 0,
+	}, nil
+}
+
+// records the state of the audit tables in a signed checkpoint
+func checkpoint(ctx context.Context, db *sql.DB, c *audit.Config) (result, error) {
+	cp, err := provisioner(c).Checkpoint(ctx, db)
+	if err != nil {
+		return result{}, err
+	}
+
+	return result{
+		value: cp,
+		text: func(w io.Writer) {
+			fmt.Fprintf(w, "checkpoint %d of %d tables\n", cp.ID, len(cp.Tables))
+			for _, t := range cp.Tables {
+				fmt.Fprintf(w, "%s.%s\tmax audit id %d\t%d rows\n", t.Schema, t.Table, t.MaxAuditID, t.Rows)
+			}
+		},
+	}, nil
+}
+
+// runs the statements of -sql or -sql-file with -reason as the maintenance
+// reason
+func maintenance(ctx context.Context, db *sql.DB, c *audit.Config) (result, error) {
+	statements, err := readStatements()
+	if err != nil {
+		return result{}, err
+	}
+
+	err = provisioner(c).Maintenance(ctx, db, *reason, statements)
+	if err != nil {
+		return result{}, err
+	}
+
+	return result{
+		value: map[string]string{"command": "maintenance", "reason": *reason},
+		text: func(w io.Writer) {
+			fmt.Fprintln(w, "maintenance finished")
+		},
+	}, nil
+}
+
+// redacts the personal columns of one row of each -table, the one given by
+// the -pk in the same place, from its audit history
+func erase(ctx context.Context, db *sql.DB, c *audit.Config) (result, error) {
+	if len(selectedTables) == 0 {
+		return result{}, errors.New("erase needs at least one -table")
+	}
+	if len(primaryKeys) != len(selectedTables) {
+		return result{}, fmt.Errorf("erase needs one -pk for each -table, got %d for %d", len(primaryKeys), len(selectedTables))
+	}
+
+	why := *reason
+	if why == "" {
+		why = "right to erasure"
+	}
+
+	targets := make([]audit.ErasureTarget, len(selectedTables))
+	for i, table := range selectedTables {
+		targets[i] = audit.ErasureTarget{Table: table, PrimaryKey: primaryKeys[i]}
+	}
+	erased, err := provisioner(c).Erase(ctx, db, targets, why)
+	if err != nil {
+		return result{}, err
+	}
+
+	type erasure struct {
+		audit.ErasureTarget
+		Rows int64 `json:"rows"`
+	}
+	erasures := make([]erasure, len(targets))
+	for i, target := range targets {
+		erasures[i] = erasure{target, erased[i]}
+	}
+
+	return result{
+		value: map[string]interface{}{"command": "erase", "reason": why, "erased": erasures},
+		text: func(w io.Writer) {
+			for _, e := range erasures {
+				fmt.Fprintf(w, "%s\tredacted %d audit rows of %s\n", e.Table, e.Rows, e.PrimaryKey)
+			}
+		},
+	}, nil
+}
+
+// the statements of maintenance are read once, as stdin can only be read by
+// the first of several databases
+var readOnce sync.Once
+var readSQL string
+var readErr error
+
+// returns the statements of -sql or -sql-file
+func readStatements() (string, error) {
+	readOnce.Do(func() {
+		readSQL = *maintenanceSQL
+		if *maintenanceFile != "" {
+			var data []byte
+			if *maintenanceFile == "-" {
+				data, readErr = ioutil.ReadAll(os.Stdin)
+			} else {
+				data, readErr = ioutil.ReadFile(*maintenanceFile)
+			}
+			readSQL = string(data)
+		}
+		if readErr == nil && strings.TrimSpace(readSQL) == "" {
+			readErr = errors.New("maintenance needs statements, given with -sql or -sql-file")
+		}
+	})
+
+	return readSQL, readErr
+}
+
+// prints every table with whether it is audited and the rule which decided it
+func listTables(ctx context.Context, db *sql.DB, c *audit.Config) (result, error) {
+	selections, err := provisioner(c).ListTables(ctx, db)
+	if err != nil {
+		return result{}, err
+	}
+
+	return result{
+		value: selections,
+		text: func(w io.Writer) {
+			for _, selection := range selections {
+				status := "rejected"
+				if selection.Selected {
+					status = "selected"
+				}
+				fmt.Fprintf(w, "%s\t%s.%s\t%s\n", status, selection.Schema, selection.Table, selection.Rule)
+			}
+		},
+	}, nil
+}
+
+// deletes audit rows older than the configured retention
+func purge(ctx context.Context, db *sql.DB, c *audit.Config) (result, error) {
+	return runResult("purge", c, provisioner(c).Purge(ctx, db))
+}
+
+// prints the version of audit_star
+func printVersion(ctx context.Context, db *sql.DB, c *audit.Config) (result, error) {
+	return result{
+		value: map[string]string{"version": version},
+		text: func(w io.Writer) {
+			fmt.Fprintln(w, version)
+		},
+	}, nil
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/enova/audit_star/audit"
+	"github.com/stretchr/testify/assert"
+)
+
+// gives a test a fresh set of flags, keeping those of the testing package,
+// and restores the flags of the command line once it finishes
+func freshFlags(t *testing.T) {
+	commandLine, cfg, replace := flag.CommandLine, cfgPath, replaceFilters
+	t.Cleanup(func() {
+		flag.CommandLine, cfgPath, replaceFilters = commandLine, cfg, replace
+		selectedTables, primaryKeys, includedTables, excludedTables, excludedSchemas = nil, nil, nil, nil, nil
+	})
+
+	flag.CommandLine = flag.NewFlagSet(commandLine.Name(), flag.ContinueOnError)
+	commandLine.VisitAll(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "test.") {
+			flag.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	selectedTables, primaryKeys, includedTables, excludedTables, excludedSchemas = nil, nil, nil, nil, nil
+	defineFlags()
+}
+
+func TestCLITablenameOverride(t *testing.T) {
+	freshFlags(t)
+	var config audit.Config
+	table := "s.t"
+	flag.Set("table", table)
+	parseFlags(&config)
+	parseCLIOverrides(&config)
+	assert.Equal(t, config.IncludedTables, []string{table})
+}
+
+func TestCLIOverrides(t *testing.T) {
+	config := audit.Config{
+		Host:           "localhost",
+		DBName:         "audit_star",
+		IncludedTables: []string{"teststar.table1"},
+		ExcludedTables: []string{"teststar.table_skipme"},
+	}
+	freshFlags(t)
+
+	flag.Set("host", "otherhost")
+	flag.Set("log_client_query", "true")
+	flag.Set("include", "teststar.table2,teststar.table3")
+	flag.Set("exclude", "teststar.*_tmp")
+	flag.Set("exclude-schema", "schema_skipme")
+	flag.Set("exclude-schema", `re:^etl_\d{1,3}$`)
+
+	err := parseCLIOverrides(&config)
+	assert.NoError(t, err)
+	assert.Equal(t, "otherhost", config.Host)
+	assert.Equal(t, "audit_star", config.DBName)
+	assert.True(t, config.LogClientQuery)
+	assert.Equal(t, []string{"teststar.table1", "teststar.table2", "teststar.table3"}, config.IncludedTables)
+	assert.Equal(t, []string{"teststar.table_skipme", "teststar.*_tmp"}, config.ExcludedTables)
+	assert.Equal(t, []string{"schema_skipme", `re:^etl_\d{1,3}$`}, config.ExcludedSchemas)
+
+	// -table replaces included_tables and must be fully-qualified
+	flag.Set("table", "teststar.table1")
+	flag.Set("table", "table2")
+	err = parseCLIOverrides(&config)
+	assert.EqualError(t, err, "-table table2: table should be specified in the following format: schemaname.tablename")
+}
@@ -68,6 +68,52 @@ CREATE SCHEMA teststar authorization test__owner;
         constraint tableskipme_pk PRIMARY KEY(id)
     );
     alter table teststar.table_skipme owner to test__owner;
+    --Table altered after being provisioned
+    create table teststar.table_refresh (
+        id int,
+        column2 text,
+        constraint tablerefresh_pk PRIMARY KEY(id)
+    );
+    alter table teststar.table_refresh owner to test__owner;
+    --Table audited with the jsonb payload engine
+    create table teststar.table_jsonb (
+        id int,
+        amount numeric(8,2),
+        active boolean,
+        details jsonb,
+        tags text[],
+        constraint tablejsonb_pk PRIMARY KEY(id)
+    );
+    alter table teststar.table_jsonb owner to test__owner;
+    --Table storing its full row on insert and update
+    create table teststar.table_full_row (
+        id int,
+        column2 text,
+        constraint tablefullrow_pk PRIMARY KEY(id)
+    );
+    alter table teststar.table_full_row owner to test__owner;
+    --Table whose no-op and timestamp-only updates are not audited
+    create table teststar.table_noop (
+        id int,
+        column2 text,
+        updated_at timestamptz,
+        constraint tablenoop_pk PRIMARY KEY(id)
+    );
+    alter table teststar.table_noop owner to test__owner;
+    create table teststar.table_override (
+        id int,
+        column2 text,
+        secret text,
+        constraint tableoverride_pk PRIMARY KEY(id)
+    );
+    alter table teststar.table_override owner to test__owner;
+    --Table whose audit rows are hash chained
+    create table teststar.table_chain (
+        id int,
+        column2 text,
+        constraint tablechain_pk PRIMARY KEY(id)
+    );
+    alter table teststar.table_chain owner to test__owner;
 --Schema in exclusion list
 create schema schema_skipme authorization test__owner;
     --Table in skipped schema
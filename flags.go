@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/enova/audit_star/audit"
+)
+
+// stringList is a flag which may be given several times, each value holding
+// one or more comma-separated entries. re: patterns are taken whole, as
+// their commas belong to the expression
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	if entry := strings.TrimSpace(value); strings.HasPrefix(entry, "re:") {
+		*l = append(*l, entry)
+		return nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			*l = append(*l, entry)
+		}
+	}
+	return nil
+}
+
+// valueList is a flag which may be given several times, keeping each value
+// whole, as primary keys may hold commas
+type valueList []string
+
+func (l *valueList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *valueList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+var cfgPath *string
+var selectedTables stringList
+var primaryKeys valueList
+var includedTables stringList
+var excludedTables stringList
+var excludedSchemas stringList
+var replaceFilters *bool
+
+// flags overriding the setting of the same name in the config file
+var settingFlags = map[string]bool{}
+
+func init() {
+	defineFlags()
+}
+
+// defines the flags of audit_star on flag.CommandLine
+func defineFlags() {
+	cfgPath = flag.String("cfg", audit.DefaultConfigPath, "Path to config file used by audit_star.")
+	replaceFilters = flag.Bool("replace-filters", false, "Make -include, -exclude and -exclude-schema replace the lists from the config file instead of adding to them.")
+	flag.Var(&selectedTables, "table", "Fully-qualified table name to be provisioned for auditing, replacing included_tables. May be repeated.")
+	flag.Var(&primaryKeys, "pk", "Primary key of the row erase redacts the personal columns of, one for each -table in turn. May be repeated.")
+	flag.Var(&includedTables, "include", "Table or pattern added to included_tables. May be repeated.")
+	flag.Var(&excludedTables, "exclude", "Table or pattern added to excluded_tables. May be repeated.")
+	flag.Var(&excludedSchemas, "exclude-schema", "Schema or pattern added to excluded_schemas. May be repeated.")
+
+	// every other flag overrides the setting of the same name
+	settingString("host", "Database host name.")
+	settingString("port", "Database port number.")
+	settingString("db_name", "Name of the database to audit.")
+	settingString("username", "Database username used to connect.")
+	settingString("ssl_mode", "Database ssl mode.")
+	settingString("ssl_root_cert", "Path to the root certificate used to verify the server.")
+	settingString("ssl_cert", "Path to the client certificate.")
+	settingString("ssl_key", "Path to the client certificate key.")
+	settingString("dsn", "Base connection string or URL.")
+	settingString("owner", "Only audit tables owned by this user.")
+	settingString("grantee", "Role granted read access to the audit tables and views.")
+	settingString("security", "Security of the audit functions, definer or invoker.")
+	settingString("set_role", "Role to set after connecting.")
+	settingString("lock_timeout", "Lock timeout used while provisioning, like 5s.")
+	settingString("payload_engine", "How the audit functions build their diffs, hstore or jsonb.")
+	settingString("retention", "Age after which purge deletes audit rows, like 90 days.")
+	settingBool("views_only", "Only (re)create the views.")
+	settingBool("log_client_query", "Log the query which caused each change.")
+	settingBool("skip_noop_updates", "Skip updates which do not change any value.")
+	settingInt("parallelism", "Number of databases of the databases section provisioned at once.")
+	settingString("log_format", "Format of the log written to stderr, text or json.")
+	settingString("log_level", "Lowest level logged, debug, info, warn or error.")
+	settingBool("continue_on_error", "Keep going when a table fails, reporting every failure at the end.")
+	settingString("report", "Path of the JSON report apply writes with the outcome of every table.")
+	settingBool("hash_chain", "Chain the rows of every audit table with SHA-256 hashes, so verify can detect tampering.")
+	settingString("checkpoint_key", "Path of the ed25519 private key, in PEM, checkpoints are signed with.")
+	settingString("checkpoint_public_key", "Path of the ed25519 public key, in PEM, checkpoints are verified with.")
+	settingString("checkpoint_file", "Path of the file checkpoints are appended to.")
+	settingString("maintenance_role", "Role whose members may change audit tables once they give a maintenance reason.")
+	settingBool("row_security", "Limit reads of the audit tables and views to the tenants audit.tenant_members lists for the reader.")
+	settingString("tenant_column", "Column of the audited tables holding the tenant of each row.")
+	settingString("tenant_setting", "Session setting holding the tenant of a change, audit_star.tenant by default.")
+}
+
+func settingString(name, usage string) {
+	flag.String(name, "", usage)
+	settingFlags[name] = true
+}
+
+func settingBool(name, usage string) {
+	flag.Bool(name, false, usage)
+	settingFlags[name] = true
+}
+
+func settingInt(name, usage string) {
+	flag.Int(name, 0, usage)
+	settingFlags[name] = true
+}
+
+// parses command line flags for configration from command line input
+func parseFlags(c *audit.Config) {
+	flag.Parse()
+	c.CfgPath = *cfgPath
+
+	// the default config file is optional, everything can be set with flags
+	if !isFlagSet("cfg") {
+		if _, err := os.Stat(c.CfgPath); os.IsNotExist(err) {
+			c.CfgPath = ""
+		}
+	}
+}
+
+// returns true if the named flag was given on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
+}
+
+// overrides the config file values with the flags given on the command line
+func parseCLIOverrides(c *audit.Config) error {
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if !settingFlags[f.Name] || err != nil {
+			return
+		}
+		err = c.Set(f.Name, f.Value.String())
+	})
+	if err != nil {
+		return err
+	}
+
+	if *replaceFilters {
+		c.IncludedTables = nil
+		c.ExcludedTables = nil
+		c.ExcludedSchemas = nil
+	}
+	c.IncludedTables = append(c.IncludedTables, includedTables...)
+	c.ExcludedTables = append(c.ExcludedTables, excludedTables...)
+	c.ExcludedSchemas = append(c.ExcludedSchemas, excludedSchemas...)
+
+	if len(selectedTables) == 0 {
+		return nil
+	}
+
+	for _, table := range selectedTables {
+		if _, err := audit.ParseTableName(table); err != nil {
+			return fmt.Errorf("-table %s: %v", table, err)
+		}
+	}
+
+	c.IncludedTables = append([]string(nil), selectedTables...)
+	return nil
+}
@@ -5,5 +5,5 @@ go 1.16
 require (
 	github.com/lib/pq v1.10.2
 	github.com/stretchr/testify v1.7.0
-	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.1
 )